@@ -33,6 +33,7 @@ type Cmd interface {
 var acceptedCommands = []string{
 	"server",
 	"agent",
+	"rotate-key",
 }
 
 func Usage() {
@@ -73,6 +74,8 @@ func Run(args []string) int {
 			instance = server.NewServer()
 		case "agent":
 			instance = agent.NewAgent()
+		case "rotate-key":
+			instance = server.NewKeyRotator()
 		default:
 			Usage()
 		}
@@ -64,6 +64,7 @@ type App struct {
 	errors     *chan LogItem
 	requesting bool
 	shasum     string
+	address    string
 }
 
 func NewApp(errors *chan LogItem, binpath string) (*App, error) {
@@ -76,7 +77,7 @@ func NewApp(errors *chan LogItem, binpath string) (*App, error) {
 	app := App{
 		Stop:   make(chan bool),
 		config: config,
-		vault:  NewVault(config.Agent.VaultAddr, config.Agent.Namespace),
+		vault:  NewVault(config.Agent.VaultAddr, config.Agent.Namespace, config.Agent.ShadowPath),
 		thor: NewThor(
 			config.Agent.ThorAddr,
 			config.Agent.Namespace,
@@ -166,8 +167,11 @@ func (a *App) cutBuffer(buffer []byte, size int) string {
 func (a *App) parseBuffer(value string) {
 	var err error
 	switch {
-	case value == "wakeup":
+	case strings.HasPrefix(value, "wakeup"):
 		*a.errors <- NewLogItem(INFO, "Recieved wakeup")
+		// The server sends the rotation job with the wakeup call
+		// and any token request must be made against that job.
+		a.thor.SetJob(strings.TrimPrefix(strings.TrimPrefix(value, "wakeup"), "|"))
 		a.woken = true
 	case value == "reregister":
 		*a.errors <- NewLogItem(INFO, "Recieved re-register")
@@ -195,7 +199,7 @@ func (a *App) parseBuffer(value string) {
 	case strings.HasPrefix(value, "tok|"):
 		*a.errors <- NewLogItem(INFO, "Recieved encrypted token")
 		value = strings.TrimPrefix(value, "tok|")
-		if err = a.vault.SetToken(value, a.config.Agent.ApiKey); err != nil {
+		if err = a.vault.SetToken(value, a.config.Agent.ApiKey, a.address); err != nil {
 			*a.errors <- NewLogItem(ERROR, err.Error())
 			a.woken = false
 			return
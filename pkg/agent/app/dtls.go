@@ -73,6 +73,7 @@ func (a *App) Dtls() {
 		return
 	}
 	*a.errors <- NewLogItem(INFO, fmt.Sprintf("Found %s", hostaddr))
+	a.address = hostaddr
 	var addresses []string = a.lookupThorIPs()
 
 	*a.errors <- NewLogItem(INFO, "Resolving UDP Address")
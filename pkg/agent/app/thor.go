@@ -32,6 +32,7 @@ type Thor struct {
 	apikey    *string
 	namespace string
 	paths     []string
+	job       string
 	requested bool
 }
 
@@ -51,6 +52,7 @@ func (thor *Thor) Register(c *config.Agent, shasum string, l *chan LogItem) erro
 		Registration: thor.publicKey(c),
 		Namespace:    thor.namespace,
 		ShaSum:       shasum,
+		Paths:        thor.paths,
 	}
 	data, err := json.Marshal(values)
 	if err != nil {
@@ -75,10 +77,16 @@ func (thor *Thor) Register(c *config.Agent, shasum string, l *chan LogItem) erro
 	return fmt.Errorf("Invalid status from registration request")
 }
 
+// Set the rotation job the next token request is made against
+func (thor *Thor) SetJob(job string) {
+	thor.job = job
+}
+
 func (thor *Thor) RequestToken() error {
 	values := server.TokenRequest{
 		Token:     *thor.apikey,
 		Namespace: thor.namespace,
+		Job:       thor.job,
 		Paths:     thor.paths,
 	}
 	data, err := json.Marshal(values)
@@ -30,15 +30,16 @@ type Vault struct {
 	thor      *Thor
 }
 
-func NewVault(address, namespace string) *Vault {
+func NewVault(address, namespace, shadowPath string) *Vault {
 	v := Vault{
 		namespace: namespace,
 		token:     "",
 		requested: false,
 	}
 	c := config.VaultConfig{
-		Address:   address,
-		Namespace: namespace,
+		Address:    address,
+		Namespace:  namespace,
+		ShadowPath: shadowPath,
 	}
 	c.Configure()
 
@@ -72,14 +73,19 @@ func (v *Vault) Unwrap(what string) (string, error) {
 	return v.backend.Unwrap(what, v.namespace)
 }
 
-func (v *Vault) SetToken(token, key string) error {
+func (v *Vault) SetToken(token, key, device string) error {
 	var err error
 	token, err = v.Unwrap(token)
 	if err != nil {
 		v.requested = false
 		return err
 	}
-	v.token = v.backend.Decrypt(token, key)
+	if v.token, err = v.backend.Decrypt(token, key, vault.AssociatedData{
+		Purpose: vault.PURPOSE_AGENT_TOKEN,
+		Device:  device,
+	}); err != nil {
+		v.requested = false
+	}
 	return err
 }
 
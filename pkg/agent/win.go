@@ -24,9 +24,9 @@ package agent
 // This service is designed to periodically poll Vault,
 // check whether a local account password has been rotated
 // and if so, change the password on the local account.
-// It will then update the "rotated" key for the secret
-// to remove the account name from the list of comma separated
-// values stored at that key
+// Rotated accounts are read from the custom metadata of
+// the secret for KV version 2 or from the Thor shadow path
+// for KV version 1
 
 import (
 	"github.com/notapipeline/thor/pkg/agent/windows"
@@ -0,0 +1,115 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum size of a single audit log line
+	MAX_LINE_SIZE = 1024 * 1024
+)
+
+// Searches rotated Vault file audit logs
+//
+// `pattern` is a glob matching the rotated logs, plain or gzip compressed.
+// Archives are read in full on each search.
+type ArchiveSource struct {
+	pattern string
+}
+
+func NewArchiveSource(pattern string) *ArchiveSource {
+	return &ArchiveSource{
+		pattern: pattern,
+	}
+}
+
+func (a *ArchiveSource) Search(identity *Identity, window Window, results *[]Result) (Summary, error) {
+	if err := ValidateUser(identity.User); err != nil {
+		return Summary{}, err
+	}
+
+	var summary Summary = Summary{
+		Query: fmt.Sprintf("archive:%s", a.pattern),
+	}
+
+	files, err := filepath.Glob(a.pattern)
+	if err != nil {
+		return summary, fmt.Errorf("Invalid audit archive pattern %s: %w", a.pattern, err)
+	}
+
+	var errs []error = make([]error, 0)
+	for _, f := range files {
+		if err := a.searchFile(f, identity, window, results); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return summary, errors.Join(errs...)
+}
+
+func (a *ArchiveSource) searchFile(path string, identity *Identity, window Window, results *[]Result) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_SIZE)
+	for scanner.Scan() {
+		entry, err := ParseEntry(scanner.Bytes())
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+
+		if !identity.Made(entry) || !window.Contains(entry.When()) {
+			continue
+		}
+
+		if p, operation, ok := entry.Access(); ok {
+			var access Access
+			access.Add(entry.When(), operation)
+			Add(results, entry.Request.Namespace.Path, p, access)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
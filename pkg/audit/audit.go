@@ -0,0 +1,186 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Sources of Vault audit entries searched during ex-employee rotation
+//
+// Each source finds the secret paths a given person has read, grouped
+// by the namespace the paths were read in.
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Format of the dates a search window is given in
+	DATE_FORMAT = "2006-01-02"
+)
+
+var (
+	DEFAULT_IGNORE_PATHS []string = []string{
+		"sys",
+	}
+
+	DEFAULT_IGNORE_WORDS []string = []string{
+		"delete",
+		"destroy",
+		"undelete",
+		"metadata",
+	}
+)
+
+var (
+	// Paths, and everything beneath them, never offered for rotation
+	ignorePaths []string = DEFAULT_IGNORE_PATHS
+
+	// KV version 2 API segments attributed to the secret they address
+	ignoreWords []string = DEFAULT_IGNORE_WORDS
+
+	emailPattern    = regexp.MustCompile(`^[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}$`)
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+)
+
+// Set the paths and KV version 2 API segments ignored when
+// normalising audited paths
+//
+// Must be called before any source is started.
+func Ignore(paths, words []string) {
+	ignorePaths, ignoreWords = paths, words
+}
+
+// Check a search term is an email address or username
+//
+// This must pass before any source is searched to protect
+// the queries built from it from abuse.
+func ValidateUser(user string) error {
+	if !emailPattern.MatchString(user) && !usernamePattern.MatchString(user) {
+		return fmt.Errorf("Invalid search term. Must be an email address or username")
+	}
+	return nil
+}
+
+// The period of time a search covers
+//
+// A zero `Start` leaves the window open to the earliest entry a
+// source holds and a zero `End` runs up to now.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Build a window from dates given as DATE_FORMAT
+//
+// Either date may be empty. The end date is inclusive.
+func ParseWindow(start, end string) (Window, error) {
+	var (
+		window Window
+		err    error
+	)
+
+	if start != "" {
+		if window.Start, err = time.Parse(DATE_FORMAT, start); err != nil {
+			return window, fmt.Errorf("Invalid start date %q", start)
+		}
+	}
+
+	if end != "" {
+		if window.End, err = time.Parse(DATE_FORMAT, end); err != nil {
+			return window, fmt.Errorf("Invalid end date %q", end)
+		}
+		window.End = window.End.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	if !window.Start.IsZero() && !window.End.IsZero() && window.End.Before(window.Start) {
+		return window, fmt.Errorf("The end date must not be before the start date")
+	}
+	return window, nil
+}
+
+func (w Window) Contains(t time.Time) bool {
+	return (w.Start.IsZero() || !t.Before(w.Start)) && (w.End.IsZero() || !t.After(w.End))
+}
+
+// Check if a period from `first` to `last` overlaps the window
+func (w Window) Overlaps(first, last time.Time) bool {
+	return (w.Start.IsZero() || !last.Before(w.Start)) && (w.End.IsZero() || !first.After(w.End))
+}
+
+// What was executed against a source
+type Summary struct {
+	// Description of the query executed
+	Query string
+
+	// Set when a limit stopped results being collected
+	// from the whole window
+	Truncated bool
+
+	// Earliest time searched where a window with no start could
+	// not be searched in full. Zero if the window was not limited.
+	Since time.Time
+}
+
+// Searched for the paths a person has accessed
+type Source interface {
+	// Search for paths accessed by `identity` during `window`
+	Search(identity *Identity, window Window, results *[]Result) (Summary, error)
+}
+
+// Searches several sources, merging their results
+//
+// Where more than one source finds a path, the path is given the
+// largest count found by any one of them.
+type MultiSource []Source
+
+func (m MultiSource) Search(identity *Identity, window Window, results *[]Result) (Summary, error) {
+	if err := ValidateUser(identity.User); err != nil {
+		return Summary{}, err
+	}
+
+	var (
+		summary Summary
+		queries []string = make([]string, 0)
+		errs    []error  = make([]error, 0)
+	)
+	for _, source := range m {
+		found := make([]Result, 0)
+		s, err := source.Search(identity, window, &found)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if s.Query != "" {
+			queries = append(queries, s.Query)
+		}
+		summary.Truncated = summary.Truncated || s.Truncated
+		if s.Since.After(summary.Since) {
+			summary.Since = s.Since
+		}
+
+		// Sources may hold the same entries, such as a file and socket
+		// fed by the same Vault, so only the largest count is taken
+		for _, r := range found {
+			for _, p := range r.Paths {
+				AddUnion(results, r.Namespace, p.Path, p.Access)
+			}
+		}
+	}
+	summary.Query = strings.Join(queries, "\n")
+	return summary, errors.Join(errs...)
+}
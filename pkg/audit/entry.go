@@ -0,0 +1,275 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/notapipeline/thor/pkg/kv"
+)
+
+const (
+	ENTRY_REQUEST  = "request"
+	ENTRY_RESPONSE = "response"
+
+	OPERATION_READ = "read"
+	OPERATION_LIST = "list"
+
+	// Prefix of values the audit device has hashed
+	HMAC_PREFIX = "hmac-sha256:"
+
+	// Separates the identifiers of an entry in an index key
+	KEY_SEPARATOR = "\x1f"
+)
+
+// Mount types holding static secrets which can be rotated
+var kvMountTypes []string = []string{
+	"kv",
+	"generic",
+}
+
+// Authentication details of the token making a request
+type Auth struct {
+	ClientToken   string            `json:"client_token"`
+	Accessor      string            `json:"accessor"`
+	DisplayName   string            `json:"display_name"`
+	EntityId      string            `json:"entity_id"`
+	Policies      []string          `json:"policies"`
+	TokenPolicies []string          `json:"token_policies"`
+	Metadata      map[string]string `json:"metadata"`
+	TokenType     string            `json:"token_type"`
+}
+
+type Namespace struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+type Request struct {
+	ID                  string                 `json:"id"`
+	Operation           string                 `json:"operation"`
+	ClientToken         string                 `json:"client_token"`
+	ClientTokenAccessor string                 `json:"client_token_accessor"`
+	Path                string                 `json:"path"`
+	MountPoint          string                 `json:"mount_point"`
+	MountType           string                 `json:"mount_type"`
+	Namespace           Namespace              `json:"namespace"`
+	RemoteAddress       string                 `json:"remote_address"`
+	Data                map[string]interface{} `json:"data"`
+}
+
+type Response struct {
+	MountPoint string                 `json:"mount_point"`
+	MountType  string                 `json:"mount_type"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// A single Vault audit entry
+//
+// Request and response entries share the same shape, a request
+// entry simply has no response. String values the audit device
+// has hashed are kept as given, see IsHMAC.
+type Entry struct {
+	Time     string    `json:"time"`
+	Type     string    `json:"type"`
+	Auth     Auth      `json:"auth"`
+	Request  Request   `json:"request"`
+	Response *Response `json:"response"`
+	Error    string    `json:"error"`
+}
+
+func ParseEntry(line []byte) (*Entry, error) {
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("Invalid audit entry: %w", err)
+	}
+	return &entry, nil
+}
+
+// Check if a value has been hashed by the audit device
+func IsHMAC(value string) bool {
+	return strings.HasPrefix(value, HMAC_PREFIX)
+}
+
+// The time the entry was written, or now if it cannot be read
+func (e *Entry) When() time.Time {
+	when, err := time.Parse(time.RFC3339Nano, e.Time)
+	if err != nil {
+		return time.Now()
+	}
+	return when
+}
+
+// Check if an identity taken from an entry is `user`
+//
+// Vault prefixes display names with the auth mount, for example
+// `ldap-jdoe`. Only the prefix of a known auth mount is removed
+// before the name must match in full.
+func matches(identity, user string, mounts []string) bool {
+	identity, user = strings.ToLower(identity), strings.ToLower(user)
+	if identity == user {
+		return true
+	}
+
+	for _, mount := range mounts {
+		if name, ok := strings.CutPrefix(identity, strings.ToLower(mount)+"-"); ok && name == user {
+			return true
+		}
+	}
+	return false
+}
+
+// The identifiers the entry can be attributed to
+//
+// Hashed names cannot be matched and are left out. Token accessors
+// are kept as given as they are matched against their hashed form.
+func (e *Entry) Identities() []string {
+	identities := make([]string, 0)
+	for _, i := range append([]string{e.Auth.DisplayName, e.Auth.EntityId}, mapValues(e.Auth.Metadata)...) {
+		if i != "" && !IsHMAC(i) && !slices.Contains(identities, i) {
+			identities = append(identities, i)
+		}
+	}
+
+	for _, i := range []string{e.Auth.Accessor, e.Request.ClientTokenAccessor} {
+		if i != "" && !slices.Contains(identities, i) {
+			identities = append(identities, i)
+		}
+	}
+	return identities
+}
+
+// Key an entry is indexed under so it is counted once however
+// many of its identifiers match a person
+//
+// The key holds every identifier of the entry in lower case.
+func (e *Entry) Key() string {
+	identities := make([]string, 0)
+	for _, i := range e.Identities() {
+		if i = strings.ToLower(i); !slices.Contains(identities, i) {
+			identities = append(identities, i)
+		}
+	}
+	return strings.Join(identities, KEY_SEPARATOR)
+}
+
+// The identifiers held in an index key
+func KeyIdentities(key string) []string {
+	return strings.Split(key, KEY_SEPARATOR)
+}
+
+// The secret path and operation of a successful response, if any
+//
+// Reads are given as the data path of the secret and lists as the
+// path of the folder listed. Requests to mounts other than KV and
+// to ignored paths are not reported.
+func (e *Entry) Access() (string, string, bool) {
+	if e.Type != ENTRY_RESPONSE || e.Error != "" {
+		return "", "", false
+	}
+
+	var mountPoint, mountType string = e.Request.MountPoint, e.Request.MountType
+	if e.Response != nil {
+		if mountPoint == "" {
+			mountPoint = e.Response.MountPoint
+		}
+		if mountType == "" {
+			mountType = e.Response.MountType
+		}
+	}
+
+	if mountType != "" && !slices.Contains(kvMountTypes, mountType) {
+		return "", "", false
+	}
+
+	switch e.Request.Operation {
+	case OPERATION_READ:
+		if p, ok := NormalisePath(mountPoint, e.Request.Path); ok {
+			return p, OPERATION_READ, true
+		}
+	case OPERATION_LIST:
+		if p, ok := normaliseFolder(mountPoint, e.Request.Path); ok {
+			return p, OPERATION_LIST, true
+		}
+	}
+	return "", "", false
+}
+
+// Normalise a path read from an audit entry to the data path of the secret
+//
+// `mountPoint` is the mount the request was served by if known. KV
+// version 1 and version 2 paths are both accepted. Returns false for
+// paths which should not be offered for rotation.
+func NormalisePath(mountPoint, path string) (string, bool) {
+	if strings.HasSuffix(path, "/") {
+		return "", false
+	}
+
+	secret, ok := guess(mountPoint, path)
+	if !ok || secret.Key == "" {
+		return "", false
+	}
+
+	// Only the data path reveals the secret, other KV version 2
+	// API paths are attributed to it if configured to be
+	if secret.Api != "" && secret.Api != kv.API_DATA && !slices.Contains(ignoreWords, secret.Api) {
+		return "", false
+	}
+	return secret.DataPath(), true
+}
+
+// Normalise a listed path to the folder it lists
+func normaliseFolder(mountPoint, path string) (string, bool) {
+	secret, ok := guess(mountPoint, path)
+	if !ok {
+		return "", false
+	}
+	return secret.ListPath(), true
+}
+
+func guess(mountPoint, path string) (*kv.Secret, bool) {
+	var pathSegments []string = strings.Split(kv.Clean(path), "/")
+	if len(pathSegments) < 2 {
+		return nil, false
+	}
+
+	var mount string = pathSegments[0]
+	if mountPoint != "" && strings.HasPrefix(kv.Clean(path)+"/", kv.Clean(mountPoint)+"/") {
+		mount = mountPoint
+	}
+
+	for _, ignore := range ignorePaths {
+		if strings.HasPrefix(kv.Clean(path)+"/", kv.Clean(ignore)+"/") {
+			return nil, false
+		}
+	}
+
+	// Any KV version 2 API path is resolved to the secret it addresses
+	return kv.Guess(mount, path), true
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0)
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,121 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNormalisePath(t *testing.T) {
+	tests := []struct {
+		name       string
+		mountPoint string
+		path       string
+		expected   string
+		ok         bool
+	}{
+		{"kv1", "secret/", "secret/db", "secret/db", true},
+		{"kv2 data", "secret/", "secret/data/db", "secret/data/db", true},
+		{"kv2 metadata", "secret/", "secret/metadata/db", "secret/data/db", true},
+		{"kv2 destroy", "secret/", "secret/destroy/db", "secret/data/db", true},
+		{"kv2 subkeys", "secret/", "secret/subkeys/db", "", false},
+		{"nested mount", "team/a/kv/", "team/a/kv/data/app/db", "team/a/kv/data/app/db", true},
+		{"unknown mount", "", "secret/data/db", "secret/data/db", true},
+		{"folder", "secret/", "secret/app/", "", false},
+		{"mount only", "secret/", "secret", "", false},
+		{"kv2 api only", "secret/", "secret/data", "", false},
+		{"ignored path", "sys/", "sys/mounts", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := NormalisePath(tt.mountPoint, tt.path)
+			if p != tt.expected || ok != tt.ok {
+				t.Errorf("expected %q %t, got %q %t", tt.expected, tt.ok, p, ok)
+			}
+		})
+	}
+}
+
+func TestEntryIdentities(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     Auth
+		request  Request
+		expected []string
+	}{
+		{
+			"every identifier",
+			Auth{DisplayName: "ldap-jdoe", EntityId: "entity-1", Accessor: "accessor-1", Metadata: map[string]string{"username": "jdoe"}},
+			Request{ClientTokenAccessor: "accessor-1"},
+			[]string{"ldap-jdoe", "entity-1", "jdoe", "accessor-1"},
+		},
+		{
+			"hashed names are left out",
+			Auth{DisplayName: HMAC_PREFIX + "name", Metadata: map[string]string{"username": HMAC_PREFIX + "jdoe"}},
+			Request{ClientTokenAccessor: HMAC_PREFIX + "accessor"},
+			[]string{HMAC_PREFIX + "accessor"},
+		},
+		{
+			"duplicates",
+			Auth{DisplayName: "jdoe", Metadata: map[string]string{"username": "jdoe"}},
+			Request{},
+			[]string{"jdoe"},
+		},
+		{"none", Auth{}, Request{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := Entry{Auth: tt.auth, Request: tt.request}
+			if identities := entry.Identities(); !slices.Equal(identities, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, identities)
+			}
+		})
+	}
+}
+
+func TestEntryKey(t *testing.T) {
+	entry := Entry{Auth: Auth{DisplayName: "LDAP-JDoe", EntityId: "Entity-1", Metadata: map[string]string{"username": "ldap-jdoe"}}}
+	if key := KeyIdentities(entry.Key()); !slices.Equal(key, []string{"ldap-jdoe", "entity-1"}) {
+		t.Errorf("expected lower case identifiers without duplicates, got %v", key)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	var mounts []string = []string{"ldap", "oidc-corp"}
+	tests := []struct {
+		identity string
+		user     string
+		matches  bool
+	}{
+		{"jdoe", "jdoe", true},
+		{"JDoe", "jdoe", true},
+		{"ldap-jdoe", "jdoe", true},
+		{"oidc-corp-jdoe", "jdoe", true},
+		{"userpass-jdoe", "jdoe", false},
+		{"ldap-jdoe2", "jdoe", false},
+		{"ldap-jdoe", "doe", false},
+	}
+
+	for _, tt := range tests {
+		if matches := matches(tt.identity, tt.user, mounts); matches != tt.matches {
+			t.Errorf("matches(%q, %q) expected %t", tt.identity, tt.user, tt.matches)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TAIL_INTERVAL = time.Second
+)
+
+// Tails the Vault JSON file audit log, indexing paths read by the
+// identifiers of each entry
+//
+// The log is indexed from the start when the source is started and
+// followed across log rotation. Anything rotated away before Thor was
+// started can be searched with an ArchiveSource. Each entry is indexed
+// once however many identifiers it carries, see Entry.Key.
+type FileSource struct {
+	path  string
+	mu    sync.RWMutex
+	index map[string]map[string]map[string]*Access
+	stop  chan bool
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{
+		path:  path,
+		index: make(map[string]map[string]map[string]*Access),
+		stop:  make(chan bool),
+	}
+}
+
+// Start following the audit log
+func (f *FileSource) Start() {
+	go f.tail()
+}
+
+func (f *FileSource) Stop() {
+	close(f.stop)
+}
+
+func (f *FileSource) Search(identity *Identity, window Window, results *[]Result) (Summary, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if err := ValidateUser(identity.User); err != nil {
+		return Summary{}, err
+	}
+
+	for key, namespaces := range f.index {
+		if !identity.Any(KeyIdentities(key)) {
+			continue
+		}
+
+		for namespace, paths := range namespaces {
+			for p, access := range paths {
+				if window.Overlaps(access.First, access.Last) {
+					Add(results, namespace, p, *access)
+				}
+			}
+		}
+	}
+	return Summary{Query: fmt.Sprintf("file:%s", f.path)}, nil
+}
+
+// Add a single audit entry to the index
+func (f *FileSource) add(line []byte) {
+	entry, err := ParseEntry(line)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	p, operation, ok := entry.Access()
+	if !ok {
+		return
+	}
+
+	var key string = entry.Key()
+	if key == "" {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.index[key]; !ok {
+		f.index[key] = make(map[string]map[string]*Access)
+	}
+	var namespace string = entry.Request.Namespace.Path
+	if _, ok := f.index[key][namespace]; !ok {
+		f.index[key][namespace] = make(map[string]*Access)
+	}
+	if _, ok := f.index[key][namespace][p]; !ok {
+		f.index[key][namespace][p] = &Access{}
+	}
+	f.index[key][namespace][p].Add(entry.When(), operation)
+}
+
+func (f *FileSource) tail() {
+	var (
+		file    *os.File
+		info    os.FileInfo
+		reader  *bufio.Reader
+		offset  int64
+		partial []byte
+		err     error
+	)
+
+	ticker := time.NewTicker(TAIL_INTERVAL)
+	defer ticker.Stop()
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		// Re-open the log if it has been rotated or truncated
+		if current, e := os.Stat(f.path); e == nil {
+			if file == nil || !os.SameFile(info, current) || current.Size() < offset {
+				if file != nil {
+					file.Close()
+				}
+				if file, err = os.Open(f.path); err != nil {
+					log.Errorf("Unable to open audit log %s: %v", f.path, err)
+					file = nil
+				} else {
+					info, offset, partial = current, 0, nil
+					reader = bufio.NewReader(file)
+				}
+			}
+		}
+
+		for file != nil {
+			line, err := reader.ReadBytes('\n')
+			offset += int64(len(line))
+			if err == io.EOF {
+				partial = append(partial, line...)
+				break
+			} else if err != nil {
+				log.Errorf("Unable to read audit log %s: %v", f.path, err)
+				break
+			}
+
+			if len(partial) > 0 {
+				line = append(partial, line...)
+				partial = nil
+			}
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				f.add(line)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-f.stop:
+			return
+		}
+	}
+}
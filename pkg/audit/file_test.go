@@ -0,0 +1,70 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSourcesCountEachEntryOnce(t *testing.T) {
+	var now time.Time = time.Now()
+	lines := [][]byte{
+		testEntry(t, "ldap-jdoe", "entity-1", "accessor-1", "secret/db", now),
+		testEntry(t, "ldap-jdoe", "entity-1", "accessor-1", "secret/db", now.Add(time.Minute)),
+		testEntry(t, "jdoe", "", "", "secret/db", now.Add(2*time.Minute)),
+		testEntry(t, "ldap-other", "entity-2", "accessor-2", "secret/db", now),
+	}
+
+	file := NewFileSource("audit.log")
+	for _, line := range lines {
+		file.add(line)
+	}
+
+	archive := filepath.Join(t.TempDir(), "audit.log.1")
+	if err := os.WriteFile(archive, bytes.Join(lines, []byte("\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source Source
+	}{
+		{"file", file},
+		{"archive", NewArchiveSource(archive)},
+		{"file and archive", MultiSource{file, NewArchiveSource(archive)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make([]Result, 0)
+			if _, err := tt.source.Search(testIdentity(), Window{}, &results); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != 1 || len(results[0].Paths) != 1 {
+				t.Fatalf("expected a single path, got %+v", results)
+			}
+			if p := results[0].Paths[0]; p.Count != 3 || p.Reads != 3 {
+				t.Errorf("expected 3 reads of secret/db, got %d reads of %d", p.Reads, p.Count)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"slices"
+	"strings"
+)
+
+// The person a search is for
+//
+// Starts as the email address or username searched for and is
+// extended with every identifier Vault knows the person by so
+// activity under any of their auth method aliases is found.
+type Identity struct {
+	// The email address or username searched for
+	User string `json:"user"`
+
+	// Entity and alias names
+	Names []string `json:"names"`
+
+	EntityIds []string `json:"entityIds"`
+
+	// Token accessors belonging to the entities, along with their
+	// HMAC as written by each audit device
+	Accessors []string `json:"accessors"`
+
+	// Auth mounts prefixed to display names, as Vault writes them
+	Mounts []string `json:"mounts"`
+}
+
+func NewIdentity(user string) *Identity {
+	return &Identity{
+		User:      user,
+		Names:     make([]string, 0),
+		EntityIds: make([]string, 0),
+		Accessors: make([]string, 0),
+		Mounts:    make([]string, 0),
+	}
+}
+
+func (i *Identity) AddName(name string) {
+	if name != "" && !containsFold(i.Names, name) && !strings.EqualFold(name, i.User) {
+		i.Names = append(i.Names, name)
+	}
+}
+
+func (i *Identity) AddEntity(id string) {
+	if id != "" && !slices.Contains(i.EntityIds, id) {
+		i.EntityIds = append(i.EntityIds, id)
+	}
+}
+
+func (i *Identity) AddAccessor(accessor string) {
+	if accessor != "" && !slices.Contains(i.Accessors, accessor) {
+		i.Accessors = append(i.Accessors, accessor)
+	}
+}
+
+// Add an auth mount by its path, for example `auth/ldap/`
+func (i *Identity) AddMount(path string) {
+	mount := strings.ReplaceAll(strings.Trim(strings.TrimPrefix(path, "auth/"), "/"), "/", "-")
+	if mount != "" && !slices.Contains(i.Mounts, mount) {
+		i.Mounts = append(i.Mounts, mount)
+	}
+}
+
+// Every identifier the person may appear under in an audit entry
+func (i *Identity) Identifiers() []string {
+	identifiers := []string{i.User}
+	identifiers = append(identifiers, i.Names...)
+	identifiers = append(identifiers, i.EntityIds...)
+	return append(identifiers, i.Accessors...)
+}
+
+// Check if an identifier taken from an audit entry belongs to the person
+//
+// Names may carry the prefix of a known auth mount, entity IDs
+// and accessors must match in full. Indexed sources store identifiers
+// in lower case so no match is case sensitive.
+func (i *Identity) Is(identifier string) bool {
+	if matches(identifier, i.User, i.Mounts) {
+		return true
+	}
+
+	for _, name := range i.Names {
+		if matches(identifier, name, i.Mounts) {
+			return true
+		}
+	}
+	return containsFold(i.EntityIds, identifier) || containsFold(i.Accessors, identifier)
+}
+
+// Check if an audit entry was made by the person
+func (i *Identity) Made(e *Entry) bool {
+	return i.Any(e.Identities())
+}
+
+// Check if any of the identifiers of an entry belong to the person
+func (i *Identity) Any(identifiers []string) bool {
+	for _, identifier := range identifiers {
+		if i.Is(identifier) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Score weightings used to order paths for rotation
+	SCORE_REPLACEABLE = 100
+	SCORE_PER_READ    = 5
+	SCORE_MAX_READS   = 50
+	SCORE_PER_LIST    = 1
+	SCORE_MAX_LISTS   = 10
+)
+
+// Recent access scores higher, checked in order
+var scoreRecency = []struct {
+	within time.Duration
+	score  int
+}{
+	{30 * 24 * time.Hour, 30},
+	{90 * 24 * time.Hour, 20},
+	{365 * 24 * time.Hour, 10},
+}
+
+// How often and when a path was accessed by an identity
+//
+// Indexed sources only hold the first and last time a path was
+// accessed so a path is found by any window overlapping that period.
+type Access struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Count int       `json:"count"`
+	Reads int       `json:"reads"`
+	Lists int       `json:"lists"`
+}
+
+// Record an access of the path at `when`
+func (a *Access) Add(when time.Time, operation string) {
+	a.Merge(Access{
+		First: when,
+		Last:  when,
+		Count: 1,
+		Reads: boolToInt(operation == OPERATION_READ),
+		Lists: boolToInt(operation == OPERATION_LIST),
+	})
+}
+
+// Combine the accesses recorded in `o`
+func (a *Access) Merge(o Access) {
+	if o.Count == 0 {
+		return
+	}
+
+	if a.Count == 0 || o.First.Before(a.First) {
+		a.First = o.First
+	}
+	if o.Last.After(a.Last) {
+		a.Last = o.Last
+	}
+	a.Count += o.Count
+	a.Reads += o.Reads
+	a.Lists += o.Lists
+}
+
+// Combine the accesses recorded in `o` where both may hold the
+// same entries
+//
+// The period covers both and each count is the larger of the two.
+func (a *Access) Union(o Access) {
+	if o.Count == 0 {
+		return
+	}
+
+	if a.Count == 0 || o.First.Before(a.First) {
+		a.First = o.First
+	}
+	if o.Last.After(a.Last) {
+		a.Last = o.Last
+	}
+	a.Count = max(a.Count, o.Count)
+	a.Reads = max(a.Reads, o.Reads)
+	a.Lists = max(a.Lists, o.Lists)
+}
+
+// A single path accessed by a person
+type Path struct {
+	Path string `json:"path"`
+	Access
+
+	// Replaceable keys held at the path, where known
+	Replaceable []string `json:"replaceable"`
+
+	// Paths are rotated highest score first
+	Score int `json:"score"`
+}
+
+// Paths which have only been listed hold no secret to rotate
+func (p *Path) Rotatable() bool {
+	return p.Reads > 0
+}
+
+// Score the path from how it was accessed and what it holds
+func (p *Path) Rank(now time.Time) {
+	p.Score = 0
+	if len(p.Replaceable) > 0 {
+		p.Score += SCORE_REPLACEABLE
+	}
+	p.Score += min(p.Reads*SCORE_PER_READ, SCORE_MAX_READS)
+	p.Score += min(p.Lists*SCORE_PER_LIST, SCORE_MAX_LISTS)
+
+	if p.Count == 0 {
+		return
+	}
+
+	for _, r := range scoreRecency {
+		if now.Sub(p.Last) <= r.within {
+			p.Score += r.score
+			break
+		}
+	}
+}
+
+// The paths accessed by a person in a single namespace
+type Result struct {
+	Namespace string
+	Paths     []*Path
+}
+
+func (r *Result) Contains(what string) bool {
+	return r.Get(what) != nil
+}
+
+func (r *Result) Get(what string) *Path {
+	for _, p := range r.Paths {
+		if p.Path == what {
+			return p
+		}
+	}
+	return nil
+}
+
+// The highest score of any path in the namespace
+func (r *Result) Score() int {
+	var score int
+	for _, p := range r.Paths {
+		score = max(score, p.Score)
+	}
+	return score
+}
+
+// Add an access of a path to the result for a namespace
+func Add(results *[]Result, namespace, path string, access Access) {
+	add(results, namespace, path, access, (*Access).Merge)
+}
+
+// Add an access of a path which may already be held in the results
+//
+// Used where the accesses come from sources holding the same entries
+// so they are not counted twice, see Access.Union.
+func AddUnion(results *[]Result, namespace, path string, access Access) {
+	add(results, namespace, path, access, (*Access).Union)
+}
+
+func add(results *[]Result, namespace, path string, access Access, merge func(*Access, Access)) {
+	namespace = strings.Trim(namespace, "/")
+	for i, r := range *results {
+		if r.Namespace == namespace {
+			if p := r.Get(path); p != nil {
+				merge(&p.Access, access)
+				return
+			}
+			(*results)[i].Paths = append(r.Paths, &Path{Path: path, Access: access})
+			return
+		}
+	}
+	*results = append(*results, Result{
+		Namespace: namespace,
+		Paths:     []*Path{{Path: path, Access: access}},
+	})
+}
+
+// Score every path and order the results for rotation
+//
+// Paths are ordered highest score first, then by path. Namespaces
+// are ordered by the highest scoring path they hold.
+func Rank(results []Result) {
+	var now time.Time = time.Now()
+	for _, r := range results {
+		for _, p := range r.Paths {
+			p.Rank(now)
+		}
+
+		sort.SliceStable(r.Paths, func(i, j int) bool {
+			if r.Paths[i].Score != r.Paths[j].Score {
+				return r.Paths[i].Score > r.Paths[j].Score
+			}
+			return r.Paths[i].Path < r.Paths[j].Path
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score() > results[j].Score()
+	})
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
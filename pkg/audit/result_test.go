@@ -0,0 +1,116 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdd(t *testing.T) {
+	var (
+		now     time.Time = time.Now()
+		earlier time.Time = now.Add(-time.Hour)
+		results []Result  = make([]Result, 0)
+		read    Access
+		list    Access
+	)
+	read.Add(now, OPERATION_READ)
+	list.Add(earlier, OPERATION_LIST)
+
+	Add(&results, "/team/", "secret/db", read)
+	Add(&results, "team", "secret/db", list)
+	Add(&results, "team", "secret/app", read)
+	Add(&results, "", "secret/db", read)
+
+	if len(results) != 2 || results[0].Namespace != "team" || results[1].Namespace != "" {
+		t.Fatalf("expected the team and root namespaces, got %+v", results)
+	}
+
+	p := results[0].Get("secret/db")
+	if p == nil || p.Count != 2 || p.Reads != 1 || p.Lists != 1 || !p.First.Equal(earlier) || !p.Last.Equal(now) {
+		t.Errorf("expected one read and one list of secret/db, got %+v", p)
+	}
+
+	AddUnion(&results, "team", "secret/db", Access{First: earlier, Last: now, Count: 1, Reads: 1})
+	if p = results[0].Get("secret/db"); p.Count != 2 || p.Reads != 1 {
+		t.Errorf("expected the union to keep the larger count, got %+v", p)
+	}
+
+	AddUnion(&results, "team", "secret/db", Access{First: earlier.Add(-time.Hour), Last: now, Count: 3, Reads: 3})
+	if p = results[0].Get("secret/db"); p.Count != 3 || p.Reads != 3 || p.Lists != 1 || !p.First.Equal(earlier.Add(-time.Hour)) {
+		t.Errorf("expected the union to take the larger count and wider period, got %+v", p)
+	}
+}
+
+func TestPathRank(t *testing.T) {
+	var now time.Time = time.Now()
+	tests := []struct {
+		name     string
+		path     Path
+		expected int
+	}{
+		{"never accessed", Path{}, 0},
+		{"replaceable", Path{Replaceable: []string{"password"}}, SCORE_REPLACEABLE},
+		{"recent read", Path{Access: Access{Last: now, Count: 1, Reads: 1}}, SCORE_PER_READ + 30},
+		{"old list", Path{Access: Access{Last: now.Add(-60 * 24 * time.Hour), Count: 2, Lists: 2}}, 2*SCORE_PER_LIST + 20},
+		{"ancient", Path{Access: Access{Last: now.Add(-400 * 24 * time.Hour), Count: 1, Reads: 1}}, SCORE_PER_READ},
+		{"reads capped", Path{Access: Access{Last: now.Add(-200 * 24 * time.Hour), Count: 100, Reads: 100}}, SCORE_MAX_READS + 10},
+		{"lists capped", Path{Access: Access{Last: now.Add(-400 * 24 * time.Hour), Count: 100, Lists: 100}}, SCORE_MAX_LISTS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.path.Rank(now)
+			if tt.path.Score != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, tt.path.Score)
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	var now time.Time = time.Now()
+	results := []Result{
+		{
+			Namespace: "low",
+			Paths: []*Path{
+				{Path: "secret/b", Access: Access{Last: now, Count: 1, Lists: 1}},
+				{Path: "secret/a", Access: Access{Last: now, Count: 1, Lists: 1}},
+			},
+		},
+		{
+			Namespace: "high",
+			Paths: []*Path{
+				{Path: "secret/read", Access: Access{Last: now, Count: 1, Reads: 1}},
+				{Path: "secret/replaceable", Replaceable: []string{"password"}, Access: Access{Last: now, Count: 1, Reads: 1}},
+			},
+		},
+	}
+
+	Rank(results)
+
+	if results[0].Namespace != "high" || results[1].Namespace != "low" {
+		t.Errorf("expected the highest scoring namespace first, got %s then %s", results[0].Namespace, results[1].Namespace)
+	}
+	if results[0].Paths[0].Path != "secret/replaceable" {
+		t.Errorf("expected the replaceable path first, got %s", results[0].Paths[0].Path)
+	}
+	if results[1].Paths[0].Path != "secret/a" {
+		t.Errorf("expected equal scores to be ordered by path, got %s", results[1].Paths[0].Path)
+	}
+}
@@ -0,0 +1,280 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Accesses indexed by the identifiers of each entry
+	AUDIT_ENTRY_TABLE = "audit_entries"
+
+	// Accesses indexed against each identifier in turn by earlier
+	// versions, only read
+	AUDIT_INDEX_TABLE = "audit_index"
+
+	// Bucket name used for entries in the root namespace
+	ROOT_NAMESPACE = "/"
+)
+
+// Receives the stream of a Vault `socket` audit device
+//
+// Every path read is indexed in bolt by the identifiers of the entry,
+// then namespace, so searches cover all history since the audit device
+// was enabled. Each entry is indexed once however many identifiers
+// it carries.
+//
+// `address` is either `tcp://host:port` or `unix:///path/to/socket`.
+// TCP connections are only accepted from `trusted` addresses, or
+// loopback if none are given.
+type SocketSource struct {
+	address  string
+	trusted  []string
+	db       *bolt.DB
+	listener net.Listener
+}
+
+func NewSocketSource(address string, trusted []string, db *bolt.DB) *SocketSource {
+	return &SocketSource{
+		address: address,
+		trusted: trusted,
+		db:      db,
+	}
+}
+
+// Start listening for the audit stream
+func (s *SocketSource) Start() error {
+	u, err := url.Parse(s.address)
+	if err != nil {
+		return fmt.Errorf("Invalid audit socket address %s: %w", s.address, err)
+	}
+
+	if err = s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(AUDIT_ENTRY_TABLE))
+		return err
+	}); err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		s.listener, err = net.Listen("tcp", u.Host)
+	case "unix":
+		// Remove any socket left behind by a previous run
+		if err = os.Remove(u.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if s.listener, err = net.Listen("unix", u.Path); err == nil {
+			err = os.Chmod(u.Path, 0600)
+		}
+	default:
+		return fmt.Errorf("Unsupported audit socket scheme %q", u.Scheme)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %s: %w", s.address, err)
+	}
+
+	log.Infof("Receiving vault audit stream on %s", s.address)
+	go s.accept()
+	return nil
+}
+
+func (s *SocketSource) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *SocketSource) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.Errorf("Audit socket: %v", err)
+			return
+		}
+
+		if !s.isTrusted(conn.RemoteAddr()) {
+			log.Warnf("Rejecting audit stream from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go s.receive(conn)
+	}
+}
+
+func (s *SocketSource) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		// unix sockets are protected by file permissions
+		return true
+	}
+
+	if len(s.trusted) == 0 {
+		return tcp.IP.IsLoopback()
+	}
+	return slices.Contains(s.trusted, tcp.IP.String())
+}
+
+func (s *SocketSource) receive(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), MAX_LINE_SIZE)
+	for scanner.Scan() {
+		entry, err := ParseEntry(scanner.Bytes())
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+
+		if err = s.index(entry); err != nil {
+			log.Errorf("Unable to index audit entry: %v", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Errorf("Audit socket: %v", err)
+	}
+}
+
+// Record the path read by an entry against its identifiers
+func (s *SocketSource) index(entry *Entry) error {
+	p, operation, ok := entry.Access()
+	if !ok {
+		return nil
+	}
+
+	var key string = entry.Key()
+	if key == "" {
+		return nil
+	}
+
+	var when time.Time = entry.When()
+	var namespace string = strings.Trim(entry.Request.Namespace.Path, "/")
+	if namespace == "" {
+		namespace = ROOT_NAMESPACE
+	}
+
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		i, err := tx.Bucket([]byte(AUDIT_ENTRY_TABLE)).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		n, err := i.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+
+		var access Access
+		if v := n.Get([]byte(p)); v != nil {
+			if err := json.Unmarshal(v, &access); err != nil {
+				return err
+			}
+		}
+		access.Add(when, operation)
+
+		b, err := json.Marshal(access)
+		if err != nil {
+			return err
+		}
+		return n.Put([]byte(p), b)
+	})
+}
+
+func (s *SocketSource) Search(identity *Identity, window Window, results *[]Result) (Summary, error) {
+	if err := ValidateUser(identity.User); err != nil {
+		return Summary{}, err
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if index := tx.Bucket([]byte(AUDIT_ENTRY_TABLE)); index != nil {
+			err := index.ForEach(func(key, v []byte) error {
+				// Only buckets are stored at the top level
+				if v != nil || !identity.Any(KeyIdentities(string(key))) {
+					return nil
+				}
+				return search(index.Bucket(key), window, results, Add)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Each entry was counted against every one of its identifiers
+		// so only the largest count held for a path is taken
+		index := tx.Bucket([]byte(AUDIT_INDEX_TABLE))
+		if index == nil {
+			return nil
+		}
+
+		legacy := make([]Result, 0)
+		err := index.ForEach(func(identifier, v []byte) error {
+			if v != nil || !identity.Is(string(identifier)) {
+				return nil
+			}
+			return search(index.Bucket(identifier), window, &legacy, AddUnion)
+		})
+
+		for _, r := range legacy {
+			for _, p := range r.Paths {
+				Add(results, r.Namespace, p.Path, p.Access)
+			}
+		}
+		return err
+	})
+	return Summary{Query: fmt.Sprintf("socket:%s", s.address)}, err
+}
+
+// Add the accesses held in the namespaces of an index bucket
+func search(bucket *bolt.Bucket, window Window, results *[]Result, add func(*[]Result, string, string, Access)) error {
+	return bucket.ForEach(func(namespace, _ []byte) error {
+		var ns string = string(namespace)
+		if ns == ROOT_NAMESPACE {
+			ns = ""
+		}
+
+		return bucket.Bucket(namespace).ForEach(func(p, v []byte) error {
+			var access Access
+			if err := json.Unmarshal(v, &access); err != nil {
+				return err
+			}
+
+			// Only reads were indexed before operations were counted
+			if access.Reads+access.Lists == 0 {
+				access.Reads = access.Count
+			}
+
+			if window.Overlaps(access.First, access.Last) {
+				add(results, ns, string(p), access)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,104 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Build a response entry for a KV version 1 read made by a token
+// carrying a display name, entity and accessor
+func testEntry(t *testing.T, name, entity, accessor, path string, when time.Time) []byte {
+	t.Helper()
+	line, err := json.Marshal(Entry{
+		Time: when.Format(time.RFC3339Nano),
+		Type: ENTRY_RESPONSE,
+		Auth: Auth{
+			DisplayName: name,
+			EntityId:    entity,
+			Accessor:    accessor,
+		},
+		Request: Request{
+			Operation:  OPERATION_READ,
+			Path:       path,
+			MountPoint: "secret/",
+			MountType:  "kv",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func testIdentity() *Identity {
+	identity := NewIdentity("jdoe")
+	identity.AddMount("auth/ldap/")
+	identity.AddEntity("entity-1")
+	identity.AddAccessor("accessor-1")
+	return identity
+}
+
+func TestSocketSourceCountsEachEntryOnce(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "thor.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(AUDIT_ENTRY_TABLE))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		source *SocketSource = NewSocketSource("tcp://127.0.0.1:0", nil, db)
+		now    time.Time     = time.Now()
+	)
+	for _, line := range [][]byte{
+		testEntry(t, "ldap-jdoe", "entity-1", "accessor-1", "secret/db", now),
+		testEntry(t, "ldap-jdoe", "entity-1", "accessor-1", "secret/db", now.Add(time.Minute)),
+		testEntry(t, "ldap-other", "entity-2", "accessor-2", "secret/db", now),
+	} {
+		entry, err := ParseEntry(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = source.index(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make([]Result, 0)
+	if _, err = source.Search(testIdentity(), Window{}, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || len(results[0].Paths) != 1 {
+		t.Fatalf("expected a single path, got %+v", results)
+	}
+	if p := results[0].Paths[0]; p.Path != "secret/db" || p.Count != 2 || p.Reads != 2 {
+		t.Errorf("expected 2 reads of secret/db, got %s with %d reads of %d", p.Path, p.Reads, p.Count)
+	}
+}
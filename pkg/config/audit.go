@@ -0,0 +1,76 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import "fmt"
+
+const (
+	AUDIT_SOURCE_LOKI    = "loki"
+	AUDIT_SOURCE_FILE    = "file"
+	AUDIT_SOURCE_ARCHIVE = "archive"
+	AUDIT_SOURCE_SOCKET  = "socket"
+)
+
+// A single source of vault audit entries
+//
+// `Path` is the audit log for a file source or a glob
+// matching rotated logs for an archive source.
+//
+// `Address` is where a socket source listens, either
+// `tcp://host:port` or `unix:///path/to/socket`, and
+// `Trusted` the addresses allowed to connect over TCP.
+type AuditSourceConfig struct {
+	Type    string   `yaml:"type"`
+	Path    string   `yaml:"path,omitempty"`
+	Address string   `yaml:"address,omitempty"`
+	Trusted []string `yaml:"trusted,omitempty"`
+}
+
+// Sources searched during ex-employee rotation
+//
+// `IgnorePaths` are paths never offered for rotation along with
+// everything beneath them. `IgnoreWords` are the KV version 2 API
+// segments, other than `data`, whose use is treated as access to the
+// secret they address. Defaults are used for either when not set.
+type AuditConfig struct {
+	Sources     []AuditSourceConfig `yaml:"sources"`
+	IgnorePaths []string            `yaml:"ignorePaths,omitempty"`
+	IgnoreWords []string            `yaml:"ignoreWords,omitempty"`
+
+	// Search for the accessors of tokens issued to the person. This
+	// looks up every token in Vault on each search.
+	ResolveTokens bool `yaml:"resolveTokens,omitempty"`
+}
+
+func (a *AuditConfig) Configure() error {
+	for _, source := range a.Sources {
+		switch source.Type {
+		case AUDIT_SOURCE_LOKI:
+		case AUDIT_SOURCE_FILE, AUDIT_SOURCE_ARCHIVE:
+			if source.Path == "" {
+				return fmt.Errorf("Audit source %s requires a path", source.Type)
+			}
+		case AUDIT_SOURCE_SOCKET:
+			if source.Address == "" {
+				return fmt.Errorf("Audit source %s requires an address", source.Type)
+			}
+		default:
+			return fmt.Errorf("Unknown audit source type %q", source.Type)
+		}
+	}
+	return nil
+}
@@ -33,19 +33,22 @@ const (
 )
 
 type Agent struct {
-	VaultAddr string     `yaml:"vaultServer"`
-	ThorAddr  string     `yaml:"thorServer"`
-	Paths     []string   `yaml:"paths"`
-	Namespace string     `yaml:"namespace"`
-	TLS       *TlsConfig `yaml:"tls"`
-	Edge      bool       `yaml:"edge" default:"false"`
-	ApiKey    string     `yaml:"-"`
+	VaultAddr string   `yaml:"vaultServer"`
+	ThorAddr  string   `yaml:"thorServer"`
+	Paths     []string `yaml:"paths"`
+	Namespace string   `yaml:"namespace"`
+	// Must match the shadowPath of the server when reading KV version 1
+	ShadowPath string     `yaml:"shadowPath"`
+	TLS        *TlsConfig `yaml:"tls"`
+	Edge       bool       `yaml:"edge" default:"false"`
+	ApiKey     string     `yaml:"-"`
 }
 
 type User struct {
 	Admin  bool
 	Email  string
 	Groups []string
+	Role   string
 }
 
 type Admin struct {
@@ -68,8 +71,10 @@ type Config struct {
 	TLS            *TlsConfig   `yaml:"tls"`
 	Vault          *VaultConfig `yaml:"vault"`
 	Loki           *LokiConfig  `yaml:"loki"`
+	Audit          *AuditConfig `yaml:"audit"`
 	Ldap           *LdapConfig  `yaml:"ldap"`
 	Saml           *SamlConfig  `yaml:"saml"`
+	Oidc           *OidcConfig  `yaml:"oidc,omitempty"`
 	Admin          *Admin       `yaml:"admin"`
 	Agent          *Agent       `yaml:"agent"`
 	Configured     bool         `yaml:"configured"`
@@ -102,8 +107,22 @@ func NewConfig(filename string) (*Config, error) {
 		c.Loki.Configure()
 	}
 
+	if c.Audit != nil {
+		if err := c.Audit.Configure(); err != nil {
+			return nil, fmt.Errorf("Invalid audit config: %w", err)
+		}
+	}
+
 	if c.Ldap != nil {
-		c.Ldap.Configure()
+		if err := c.Ldap.Configure(); err != nil {
+			return nil, fmt.Errorf("Invalid ldap config: %w", err)
+		}
+	}
+
+	if c.Oidc != nil {
+		if err := c.Oidc.Configure(); err != nil {
+			return nil, fmt.Errorf("Invalid oidc config: %w", err)
+		}
 	}
 
 	if c.Saml != nil {
@@ -16,13 +16,115 @@
 
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	LDAP_TLS_NONE     = "none"
+	LDAP_TLS_LDAPS    = "ldaps"
+	LDAP_TLS_STARTTLS = "starttls"
+
+	// Active Directory marks disabled accounts in userAccountControl
+	LDAP_AD_DISABLED_ATTRIBUTE = "userAccountControl"
+
+	DEFAULT_LDAP_FILTER = "(&(objectClass=person)(|(sAMAccountName={username})(mail={username})(uid={username})))"
+)
+
 type LdapConfig struct {
 	Server      string `yaml:"server"`
 	Port        int    `yaml:"port"`
 	BindAccount string `yaml:"bindAccount"`
-	Password    string `yaml:"password"`
-	BaseDN      string `yaml:"baseDn"`
-	FilterDN    string `yaml:"filterDn"`
+
+	// Vault path holding the bind `password`
+	PasswordPath string `yaml:"passwordPath"`
+
+	// Deprecated: use PasswordPath
+	Password string `yaml:"password,omitempty"`
+
+	BaseDN string `yaml:"baseDn"`
+
+	// Filter used to find an account. `{username}` is replaced with
+	// the escaped email address or username being looked up.
+	FilterDN string `yaml:"filterDn"`
+
+	// One of `none`, `ldaps` or `starttls`
+	TLS                string `yaml:"tls"`
+	Cacert             string `yaml:"cacert"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+
+	// Allow sign in over a connection with no TLS, sending
+	// passwords to the directory in cleartext
+	AllowInsecure bool `yaml:"allowInsecure,omitempty"`
+
+	// Attribute marking an account as disabled. For
+	// userAccountControl the ACCOUNTDISABLE flag is checked,
+	// otherwise the attribute must equal `DisabledValue`, or
+	// be present at all if no value is given.
+	DisabledAttribute string `yaml:"disabledAttribute"`
+	DisabledValue     string `yaml:"disabledValue"`
+
+	// Allow directory accounts to sign in to Thor with the role
+	// granted by the groups they are a member of
+	Login bool        `yaml:"login"`
+	Roles RoleMapping `yaml:"roles,omitempty"`
 }
 
-func (ldap *LdapConfig) Configure() {}
+// Check if directory accounts may sign in
+func (ldap *LdapConfig) LoginEnabled() bool {
+	return ldap.Enabled() && ldap.Login
+}
+
+// Check if a directory has been configured
+func (ldap *LdapConfig) Enabled() bool {
+	return ldap != nil && ldap.Server != ""
+}
+
+func (ldap *LdapConfig) Configure() error {
+	if !ldap.Enabled() {
+		return nil
+	}
+
+	ldap.TLS = strings.ToLower(ldap.TLS)
+	switch ldap.TLS {
+	case "":
+		ldap.TLS = LDAP_TLS_NONE
+	case LDAP_TLS_NONE, LDAP_TLS_LDAPS, LDAP_TLS_STARTTLS:
+	default:
+		return fmt.Errorf("Unknown ldap tls mode %q", ldap.TLS)
+	}
+
+	if ldap.Port == 0 {
+		ldap.Port = 389
+		if ldap.TLS == LDAP_TLS_LDAPS {
+			ldap.Port = 636
+		}
+	}
+
+	if ldap.FilterDN == "" {
+		ldap.FilterDN = DEFAULT_LDAP_FILTER
+	}
+
+	if !strings.Contains(ldap.FilterDN, "{username}") {
+		return fmt.Errorf("ldap filterDn must contain {username}")
+	}
+
+	if ldap.BaseDN == "" {
+		return fmt.Errorf("ldap baseDn is required")
+	}
+
+	if ldap.DisabledAttribute == "" {
+		ldap.DisabledAttribute = LDAP_AD_DISABLED_ATTRIBUTE
+	}
+
+	if ldap.Login && ldap.TLS == LDAP_TLS_NONE && !ldap.AllowInsecure {
+		return fmt.Errorf("ldap login requires tls to be ldaps or starttls, or allowInsecure to be set")
+	}
+
+	if ldap.Login && len(ldap.Roles) == 0 {
+		return fmt.Errorf("ldap login requires at least one role to be mapped to groups")
+	}
+	return ldap.Roles.Validate()
+}
@@ -0,0 +1,53 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import "testing"
+
+func TestLdapConfigureLoginTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      string
+		login    bool
+		insecure bool
+		valid    bool
+	}{
+		{"check only without tls", "", false, false, true},
+		{"login without tls", "", true, false, false},
+		{"login with tls none", LDAP_TLS_NONE, true, false, false},
+		{"login allowed insecure", LDAP_TLS_NONE, true, true, true},
+		{"login with starttls", LDAP_TLS_STARTTLS, true, false, true},
+		{"login with ldaps", LDAP_TLS_LDAPS, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ldap := &LdapConfig{
+				Server:        "ldap.example.com",
+				BaseDN:        "DC=example,DC=com",
+				TLS:           tt.tls,
+				Login:         tt.login,
+				AllowInsecure: tt.insecure,
+				Roles:         RoleMapping{ROLE_ADMIN: {"thor"}},
+			}
+
+			if err := ldap.Configure(); (err == nil) != tt.valid {
+				t.Errorf("expected valid %t, got %v", tt.valid, err)
+			}
+		})
+	}
+}
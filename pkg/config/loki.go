@@ -16,11 +16,84 @@
 
 package config
 
+const (
+	DEFAULT_LOKI_SELECTOR = `{active="true"}`
+	DEFAULT_LOKI_PIPELINE = `|~ {{ .Pattern }} |= "type=response" | logfmt`
+
+	// Loki rejects range queries longer than 30 days by default
+	DEFAULT_LOKI_CHUNK_SIZE = "720h"
+	DEFAULT_LOKI_LIMIT      = 10000
+)
+
+// Templates used to build the LogQL query for ex-employee searches
+//
+// Templates are rendered with `.Pattern`, a quoted regular expression
+// matching the search term or any identifier Vault holds for the
+// person, and `.Literal`, the search term as a quoted string. No
+// identifier is ever inserted unescaped.
+type LokiQueryConfig struct {
+	Selector string `yaml:"selector"`
+	Pipeline string `yaml:"pipeline"`
+
+	// Names of the labels holding the audit request and response
+	RequestLabel  string `yaml:"requestLabel"`
+	ResponseLabel string `yaml:"responseLabel"`
+
+	// Searches are split into chunks of this duration, each
+	// returning at most `Limit` entries
+	ChunkSize string `yaml:"chunkSize"`
+	Limit     int    `yaml:"limit"`
+}
+
+// TLS settings for connecting to Loki over HTTPS
+type LokiTLSConfig struct {
+	Cacert             string `yaml:"cacert"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
 type LokiConfig struct {
-	Server   string `yaml:"server"`
-	Port     int    `yaml:"port"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Server string         `yaml:"server"`
+	Port   int            `yaml:"port"`
+	TLS    *LokiTLSConfig `yaml:"tls,omitempty"`
+
+	// Tenant sent as `X-Scope-OrgID` to multi-tenant Loki
+	OrgID string `yaml:"orgId"`
+
+	// Vault path holding the Loki credentials. The secret may contain
+	// either `username` and `password` or a bearer `token`.
+	CredentialsPath string `yaml:"credentialsPath"`
+
+	// Deprecated: use CredentialsPath
+	Username string `yaml:"username,omitempty"`
+	// Deprecated: use CredentialsPath
+	Password string `yaml:"password,omitempty"`
+
+	Query *LokiQueryConfig `yaml:"query,omitempty"`
 }
 
-func (loki *LokiConfig) Configure() {}
+func (loki *LokiConfig) Configure() {
+	if loki.Query == nil {
+		loki.Query = &LokiQueryConfig{}
+	}
+	if loki.Query.Selector == "" {
+		loki.Query.Selector = DEFAULT_LOKI_SELECTOR
+	}
+	if loki.Query.Pipeline == "" {
+		loki.Query.Pipeline = DEFAULT_LOKI_PIPELINE
+	}
+	if loki.Query.RequestLabel == "" {
+		loki.Query.RequestLabel = "request"
+	}
+	if loki.Query.ResponseLabel == "" {
+		loki.Query.ResponseLabel = "response"
+	}
+	if loki.Query.ChunkSize == "" {
+		loki.Query.ChunkSize = DEFAULT_LOKI_CHUNK_SIZE
+	}
+	if loki.Query.Limit <= 0 {
+		loki.Query.Limit = DEFAULT_LOKI_LIMIT
+	}
+}
@@ -0,0 +1,81 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	DEFAULT_OIDC_EMAIL_CLAIM  = "email"
+	DEFAULT_OIDC_GROUPS_CLAIM = "groups"
+)
+
+var DEFAULT_OIDC_SCOPES []string = []string{"openid", "email", "profile"}
+
+// Sign in with an OpenID Connect provider
+//
+// The authorization code flow is used with PKCE. The client secret
+// is read from the `clientSecret` key at `ClientSecretPath` in vault
+// and may be omitted for public clients.
+type OidcConfig struct {
+	Issuer           string   `yaml:"issuer"`
+	ClientID         string   `yaml:"clientId"`
+	ClientSecretPath string   `yaml:"clientSecretPath"`
+	Scopes           []string `yaml:"scopes,omitempty"`
+
+	// Claims holding the email address and groups of the user
+	EmailClaim  string `yaml:"emailClaim"`
+	GroupsClaim string `yaml:"groupsClaim"`
+
+	// Groups from `GroupsClaim` granted each Thor role
+	Roles RoleMapping `yaml:"roles,omitempty"`
+}
+
+// Check if a provider has been configured
+func (o *OidcConfig) Enabled() bool {
+	return o != nil && o.Issuer != "" && o.ClientID != ""
+}
+
+func (o *OidcConfig) Configure() error {
+	if !o.Enabled() {
+		return nil
+	}
+
+	u, err := url.Parse(o.Issuer)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("oidc issuer must be an https url")
+	}
+
+	if len(o.Scopes) == 0 {
+		o.Scopes = DEFAULT_OIDC_SCOPES
+	}
+
+	if o.EmailClaim == "" {
+		o.EmailClaim = DEFAULT_OIDC_EMAIL_CLAIM
+	}
+
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = DEFAULT_OIDC_GROUPS_CLAIM
+	}
+
+	if len(o.Roles) == 0 {
+		return fmt.Errorf("oidc requires at least one role to be mapped to groups")
+	}
+	return o.Roles.Validate()
+}
@@ -0,0 +1,74 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ROLE_ADMIN    = "admin"
+	ROLE_OPERATOR = "operator"
+)
+
+// Maps Thor roles to the directory or identity provider groups granted them
+//
+// Groups may be given as a full DN or just the common name. Members of
+// no mapped group are refused sign in.
+type RoleMapping map[string][]string
+
+func (m RoleMapping) Validate() error {
+	for role := range m {
+		if role != ROLE_ADMIN && role != ROLE_OPERATOR {
+			return fmt.Errorf("Unknown role %q, must be one of %s or %s", role, ROLE_ADMIN, ROLE_OPERATOR)
+		}
+	}
+	return nil
+}
+
+// Get the role granted to a member of `groups`
+//
+// Admin takes precedence. Returns an empty role if none is granted.
+func (m RoleMapping) Role(groups []string) string {
+	for _, role := range []string{ROLE_ADMIN, ROLE_OPERATOR} {
+		for _, mapped := range m[role] {
+			for _, group := range groups {
+				if groupMatches(group, mapped) {
+					return role
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func groupMatches(group, mapped string) bool {
+	if strings.EqualFold(group, mapped) {
+		return true
+	}
+
+	// Compare the common name of a DN such as CN=Thor,OU=Groups,DC=example
+	cn, _, _ := strings.Cut(group, ",")
+	if name, ok := strings.CutPrefix(cn, "CN="); ok {
+		return strings.EqualFold(name, mapped)
+	}
+	if name, ok := strings.CutPrefix(cn, "cn="); ok {
+		return strings.EqualFold(name, mapped)
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import "testing"
+
+func TestRoleMappingRole(t *testing.T) {
+	mapping := RoleMapping{
+		ROLE_ADMIN:    {"CN=Thor Admins,OU=Groups,DC=example,DC=com"},
+		ROLE_OPERATOR: {"thor-operators"},
+	}
+
+	tests := []struct {
+		name   string
+		groups []string
+		role   string
+	}{
+		{"no groups", nil, ""},
+		{"unmapped group", []string{"CN=Staff,OU=Groups,DC=example,DC=com"}, ""},
+		{"full dn", []string{"CN=Thor Admins,OU=Groups,DC=example,DC=com"}, ROLE_ADMIN},
+		{"dn case", []string{"cn=thor admins,ou=groups,dc=example,dc=com"}, ROLE_ADMIN},
+		{"common name", []string{"thor-operators"}, ROLE_OPERATOR},
+		{"common name of dn", []string{"CN=thor-operators,OU=Groups,DC=example,DC=com"}, ROLE_OPERATOR},
+		{"admin first", []string{"thor-operators", "CN=Thor Admins,OU=Groups,DC=example,DC=com"}, ROLE_ADMIN},
+		{"common name prefix only", []string{"CN=thor-operators-old,OU=Groups"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if role := mapping.Role(tt.groups); role != tt.role {
+				t.Errorf("expected %q, got %q", tt.role, role)
+			}
+		})
+	}
+}
+
+func TestGroupMatches(t *testing.T) {
+	tests := []struct {
+		group   string
+		mapped  string
+		matches bool
+	}{
+		{"thor", "thor", true},
+		{"THOR", "thor", true},
+		{"CN=thor,OU=Groups", "thor", true},
+		{"cn=thor,ou=groups", "thor", true},
+		{"CN=thor,OU=Groups", "CN=thor,OU=Groups", true},
+		{"OU=thor,DC=example", "thor", false},
+		{"CN=thor,OU=Groups", "Groups", false},
+		{"thor-admins", "thor", false},
+	}
+
+	for _, tt := range tests {
+		if matches := groupMatches(tt.group, tt.mapped); matches != tt.matches {
+			t.Errorf("groupMatches(%q, %q) expected %t", tt.group, tt.mapped, tt.matches)
+		}
+	}
+}
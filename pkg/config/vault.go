@@ -17,14 +17,31 @@
 package config
 
 import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
 	vault "github.com/hashicorp/vault/api"
 )
 
+const (
+	DEFAULT_KUBERNETES_TOKEN string = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
 type Policy struct {
 	ExcludeCharacters string `yaml:"excludeCharacters"`
 	Length            int    `yaml:"length"`
 }
 
+// Encrypt Thor owned material with a Vault transit key
+//
+// Key versioning and rotation is handled by the transit engine
+type TransitConfig struct {
+	Mount string `yaml:"mount"`
+	Key   string `yaml:"key"`
+}
+
 type VaultConfig struct {
 	Address string `yaml:"address"`
 	AppRole *struct {
@@ -32,6 +49,16 @@ type VaultConfig struct {
 		SecretId            string `yaml:"secretId"`
 		ResponseWrapped     bool   `yaml:"wrapped"`
 		InitialisationToken string `yaml:"InitialisationToken"`
+		RoleName            string `yaml:"roleName,omitempty"`
+		Mount               string `yaml:"mount,omitempty"`
+
+		// How often the secret-id is rotated, e.g. "24h". Rotation is
+		// disabled if this is empty.
+		RotationInterval string `yaml:"rotationInterval,omitempty"`
+
+		// Accessors are managed by Thor and should not be set by hand
+		SecretIdAccessor         string `yaml:"secretIdAccessor,omitempty"`
+		PreviousSecretIdAccessor string `yaml:"previousSecretIdAccessor,omitempty"`
 	} `yaml:"appRole,omitempty"`
 	AzureRole *struct {
 		RoleName string `yaml:"role"`
@@ -39,10 +66,38 @@ type VaultConfig struct {
 	AwsRole *struct {
 		RoleName string `yaml:"role"`
 	} `yaml:"awsRole,omitempty"`
-	Namespace       string  `yaml:"namespace"`
-	SecureTokenPath string  `yaml:"securePath"`
-	EncryptionKey   string  `yaml:"encryptionkey"`
-	PasswordPolicy  *Policy `yaml:"passwordPolicy"`
+	KubernetesRole *struct {
+		RoleName  string `yaml:"role"`
+		Mount     string `yaml:"mount"`
+		TokenPath string `yaml:"tokenPath"`
+	} `yaml:"kubernetesRole,omitempty"`
+	JwtRole *struct {
+		RoleName  string `yaml:"role"`
+		Mount     string `yaml:"mount"`
+		Token     string `yaml:"token"`
+		TokenPath string `yaml:"tokenPath"`
+	} `yaml:"jwtRole,omitempty"`
+	CertRole *struct {
+		RoleName string `yaml:"role"`
+		Mount    string `yaml:"mount"`
+		Cert     string `yaml:"cert"`
+		Key      string `yaml:"key"`
+		Cacert   string `yaml:"cacert"`
+	} `yaml:"certRole,omitempty"`
+	Userpass *struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		Mount    string `yaml:"mount"`
+	} `yaml:"userpass,omitempty"`
+	Namespace       string         `yaml:"namespace"`
+	SecureTokenPath string         `yaml:"securePath"`
+	EncryptionKey   string         `yaml:"encryptionkey"`
+	Transit         *TransitConfig `yaml:"transit,omitempty"`
+
+	// KV version 1 path rotation state is recorded under.
+	// KV version 2 secrets use custom metadata instead.
+	ShadowPath     string  `yaml:"shadowPath"`
+	PasswordPolicy *Policy `yaml:"passwordPolicy"`
 	//
 	// Replaceable is a list of keys likely to be found under
 	// a given vault path whose value can/should be replaced by
@@ -57,8 +112,108 @@ type VaultConfig struct {
 func (c *VaultConfig) Configure() {
 	c.VaultConfig = vault.DefaultConfig()
 	c.VaultConfig.Address = c.Address
+	if c.Transit != nil {
+		if c.Transit.Mount == "" {
+			c.Transit.Mount = "transit"
+		}
+		if c.Transit.Key == "" {
+			c.Transit.Key = "thor"
+		}
+	}
+	if c.AppRole != nil && c.AppRole.Mount == "" {
+		c.AppRole.Mount = "approle"
+	}
+	if c.KubernetesRole != nil {
+		if c.KubernetesRole.Mount == "" {
+			c.KubernetesRole.Mount = "kubernetes"
+		}
+		if c.KubernetesRole.TokenPath == "" {
+			c.KubernetesRole.TokenPath = DEFAULT_KUBERNETES_TOKEN
+		}
+	}
+	if c.JwtRole != nil && c.JwtRole.Mount == "" {
+		c.JwtRole.Mount = "jwt"
+	}
+	if c.CertRole != nil && c.CertRole.Mount == "" {
+		c.CertRole.Mount = "cert"
+	}
+	if c.Userpass != nil && c.Userpass.Mount == "" {
+		c.Userpass.Mount = "userpass"
+	}
 	c.TokenPolicy = &Policy{
 		ExcludeCharacters: `"\\` + "`" + `'`,
 		Length:            32,
 	}
 }
+
+// Validate the auth method the Thor server logs in to Vault with
+//
+// Exactly one method must be configured and that method must carry
+// everything it needs to log in.
+func (c *VaultConfig) Validate() error {
+	var configured []string = make([]string, 0)
+	for name, enabled := range map[string]bool{
+		"appRole":        c.AppRole != nil,
+		"azureRole":      c.AzureRole != nil,
+		"awsRole":        c.AwsRole != nil,
+		"kubernetesRole": c.KubernetesRole != nil,
+		"jwtRole":        c.JwtRole != nil,
+		"certRole":       c.CertRole != nil,
+		"userpass":       c.Userpass != nil,
+	} {
+		if enabled {
+			configured = append(configured, name)
+		}
+	}
+
+	var methods string = "`appRole`, `azureRole`, `awsRole`, `kubernetesRole`, `jwtRole`, `certRole` or `userpass`"
+	switch len(configured) {
+	case 0:
+		return fmt.Errorf("No vault auth method configured. One of %s must be set", methods)
+	case 1:
+	default:
+		slices.Sort(configured)
+		return fmt.Errorf("Multiple vault auth methods configured (%s). Only one of %s may be set",
+			strings.Join(configured, ", "), methods)
+	}
+
+	switch {
+	case c.AppRole != nil:
+		if c.AppRole.RoleId == "" && c.AppRole.InitialisationToken == "" {
+			return fmt.Errorf("appRole requires a roleId")
+		}
+		if c.AppRole.RotationInterval != "" {
+			if _, err := time.ParseDuration(c.AppRole.RotationInterval); err != nil {
+				return fmt.Errorf("appRole rotationInterval is invalid: %w", err)
+			}
+		}
+	case c.AzureRole != nil:
+		if c.AzureRole.RoleName == "" {
+			return fmt.Errorf("azureRole requires a role")
+		}
+	case c.AwsRole != nil:
+		if c.AwsRole.RoleName == "" {
+			return fmt.Errorf("awsRole requires a role")
+		}
+	case c.KubernetesRole != nil:
+		if c.KubernetesRole.RoleName == "" {
+			return fmt.Errorf("kubernetesRole requires a role")
+		}
+	case c.JwtRole != nil:
+		if c.JwtRole.RoleName == "" {
+			return fmt.Errorf("jwtRole requires a role")
+		}
+		if c.JwtRole.Token == "" && c.JwtRole.TokenPath == "" {
+			return fmt.Errorf("jwtRole requires one of token or tokenPath")
+		}
+	case c.CertRole != nil:
+		if c.CertRole.Cert == "" || c.CertRole.Key == "" {
+			return fmt.Errorf("certRole requires both cert and key")
+		}
+	case c.Userpass != nil:
+		if c.Userpass.Username == "" || c.Userpass.Password == "" {
+			return fmt.Errorf("userpass requires both username and password")
+		}
+	}
+	return nil
+}
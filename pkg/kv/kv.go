@@ -0,0 +1,249 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Resolves secret paths to the KV mount they are held in
+//
+// KV version 2 mounts expose each secret under several API paths
+// (`data`, `metadata`, `delete`, ...) beneath the mount. Mounts may
+// themselves be nested any number of levels deep such as `team/a/kv/`
+// so the mount of a path can only be found by matching it against the
+// mount table.
+package kv
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	API_DATA     = "data"
+	API_METADATA = "metadata"
+	API_SUBKEYS  = "subkeys"
+)
+
+// Segments following a KV version 2 mount which select the API
+var apiSegments []string = []string{
+	API_DATA,
+	API_METADATA,
+	"delete",
+	"undelete",
+	"destroy",
+	API_SUBKEYS,
+}
+
+// A KV secrets engine mount
+type Mount struct {
+	// Always has a trailing slash and no leading slash
+	Path    string
+	Version int
+}
+
+// A secret resolved to the mount it lives in
+type Secret struct {
+	Mount Mount
+	// Path of the secret relative to the mount
+	Key string
+	// The API segment the path was given with, if any
+	Api string
+}
+
+func (s *Secret) V2() bool {
+	return s.Mount.Version == 2
+}
+
+// Path the secret is read from and written to
+func (s *Secret) DataPath() string {
+	if s.V2() {
+		return join(s.Mount.Path, API_DATA, s.Key)
+	}
+	return join(s.Mount.Path, s.Key)
+}
+
+// Path holding the metadata of a KV version 2 secret
+//
+// Returns an empty string for KV version 1.
+func (s *Secret) MetadataPath() string {
+	if s.V2() {
+		return join(s.Mount.Path, API_METADATA, s.Key)
+	}
+	return ""
+}
+
+// Path listing the keys of a KV version 2 secret without their values
+//
+// Returns an empty string for KV version 1.
+func (s *Secret) SubkeysPath() string {
+	if s.V2() {
+		return join(s.Mount.Path, API_SUBKEYS, s.Key)
+	}
+	return ""
+}
+
+// Path the secret, treated as a folder, is listed from
+func (s *Secret) ListPath() string {
+	var p string
+	if s.V2() {
+		p = join(s.Mount.Path, API_METADATA, s.Key)
+	} else {
+		p = join(s.Mount.Path, s.Key)
+	}
+	return p + "/"
+}
+
+// Path of a child of the secret when treated as a folder
+func (s *Secret) Child(name string) *Secret {
+	return &Secret{
+		Mount: s.Mount,
+		Key:   Clean(join(s.Key, name)),
+		Api:   s.Api,
+	}
+}
+
+// Resolves paths against a known set of mounts
+type Resolver struct {
+	mounts []Mount
+}
+
+func NewResolver(mounts []Mount) *Resolver {
+	r := Resolver{
+		mounts: make([]Mount, 0),
+	}
+	for _, m := range mounts {
+		m.Path = Clean(m.Path) + "/"
+		r.mounts = append(r.mounts, m)
+	}
+
+	// Longest mount first so nested mounts are matched before their parents
+	sort.SliceStable(r.mounts, func(i, j int) bool {
+		return len(r.mounts[i].Path) > len(r.mounts[j].Path)
+	})
+	return &r
+}
+
+// Mounts known to the resolver, ordered by path
+func (r *Resolver) Mounts() []Mount {
+	mounts := make([]Mount, len(r.mounts))
+	copy(mounts, r.mounts)
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Path < mounts[j].Path
+	})
+	return mounts
+}
+
+// Find the mount a path is held in
+func (r *Resolver) Resolve(p string) (*Secret, error) {
+	p = Clean(p)
+	for _, m := range r.mounts {
+		if p+"/" == m.Path || strings.HasPrefix(p, m.Path) {
+			return Split(m, p), nil
+		}
+	}
+	return nil, fmt.Errorf("No KV mount found for %s", p)
+}
+
+// Split a path into its mount and key
+//
+// For KV version 2, any API segment following the mount is removed.
+func Split(m Mount, p string) *Secret {
+	var key string = strings.TrimPrefix(Clean(p)+"/", m.Path)
+	key = strings.TrimSuffix(key, "/")
+
+	var api string
+	if m.Version == 2 {
+		segments := strings.SplitN(key, "/", 2)
+		for _, a := range apiSegments {
+			if segments[0] == a {
+				api = a
+				key = ""
+				if len(segments) > 1 {
+					key = segments[1]
+				}
+				break
+			}
+		}
+	}
+
+	return &Secret{
+		Mount: m,
+		Key:   key,
+		Api:   api,
+	}
+}
+
+// Guess the mount of a path when only the mount path is known
+//
+// A path whose first segment after the mount selects a KV version 2
+// API is assumed to be version 2.
+func Guess(mount, p string) *Secret {
+	var m Mount = Mount{
+		Path:    Clean(mount) + "/",
+		Version: 1,
+	}
+	key := strings.TrimPrefix(Clean(p)+"/", m.Path)
+	segment := strings.SplitN(key, "/", 2)[0]
+	for _, a := range apiSegments {
+		if segment == a {
+			m.Version = 2
+			break
+		}
+	}
+	return Split(m, p)
+}
+
+// Parse the KV mounts from a `sys/mounts` response
+func ParseMounts(data map[string]interface{}) []Mount {
+	mounts := make([]Mount, 0)
+	for p, d := range data {
+		details, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if t, _ := details["type"].(string); t != "kv" {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Path:    Clean(p) + "/",
+			Version: Version(details),
+		})
+	}
+	return mounts
+}
+
+// Get the KV version of a mount from its details
+func Version(details map[string]interface{}) int {
+	options, _ := details["options"].(map[string]interface{})
+	if version, ok := options["version"].(string); ok && version == "2" {
+		return 2
+	}
+	return 1
+}
+
+// Remove duplicate, leading and trailing slashes from a path
+func Clean(p string) string {
+	segments := make([]string, 0)
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func join(parts ...string) string {
+	return Clean(strings.Join(parts, "/"))
+}
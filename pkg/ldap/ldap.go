@@ -14,137 +14,269 @@
 // You should have received a copy of the GNU General Public License along with
 // this program. If not, see <https://www.gnu.org/licenses/>.
 
+// Directory lookups against LDAP or Active Directory
+//
+// Used to confirm a person has left before their credentials are
+// rotated so nobody can rotate credentials still in active use.
 package ldap
 
-/// Perform LDAP connection and search for employee
-
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 
+	"github.com/notapipeline/thor/pkg/config"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/ldap.v2"
 )
 
 const (
-	ldapServer   = "ad.example.com:389"
-	ldapBind     = "search@example.com"
-	ldapPassword = "Password123!"
+	// userAccountControl flag set on disabled Active Directory accounts
+	AD_ACCOUNTDISABLE = 0x2
+)
 
-	filterDN = "(&(objectClass=person)(memberOf:1.2.840.113556.1.4.1941:=CN=Chat,CN=Users,DC=example,DC=com)(|(sAMAccountName={username})(mail={username})))"
-	baseDN   = "CN=Users,DC=example,DC=com"
+// Reads secrets held in Vault
+type SecretReader interface {
+	ReadSecret(path string) (map[string]string, error)
+}
 
-	loginUsername = "tboerger"
-	loginPassword = "password"
-)
+// An account found in the directory
+type Account struct {
+	DN       string
+	Username string
+	Email    string
+	Name     string
+	Disabled bool
+	// DNs of the groups the account is a member of
+	Groups []string
+}
 
-/*
-	func main() {
-		conn, err := connect()
+type Client struct {
+	config  *config.LdapConfig
+	secrets SecretReader
+}
 
-		if err != nil {
-			fmt.Printf("Failed to connect. %s", err)
-			return
+func NewClient(c *config.LdapConfig, secrets SecretReader) *Client {
+	return &Client{
+		config:  c,
+		secrets: secrets,
+	}
+}
+
+// Connect and bind with the search account
+//
+// The bind password is read from vault on each connection so
+// it is always current.
+func (c *Client) connect() (*ldap.Conn, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		conn    *ldap.Conn
+		address string = fmt.Sprintf("%s:%d", c.config.Server, c.config.Port)
+	)
+
+	if c.config.TLS == config.LDAP_TLS_LDAPS {
+		conn, err = ldap.DialTLS("tcp", address, tlsConfig)
+	} else {
+		conn, err = ldap.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %w", address, err)
+	}
+
+	if c.config.TLS == config.LDAP_TLS_STARTTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to start TLS with %s: %w", address, err)
 		}
+	}
+
+	password, err := c.password()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-		defer conn.Close()
+	if err := conn.Bind(c.config.BindAccount, password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to bind as %s: %w", c.config.BindAccount, err)
+	}
+	return conn, nil
+}
 
-		if err := list(conn); err != nil {
-			fmt.Printf("%v", err)
-			return
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		ServerName:         c.config.ServerName,
+		InsecureSkipVerify: c.config.InsecureSkipVerify,
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = c.config.Server
+	}
+
+	if c.config.Cacert != "" {
+		pem, err := os.ReadFile(c.config.Cacert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read ldap CA certificate: %w", err)
 		}
 
-		if err := auth(conn); err != nil {
-			fmt.Printf("%v", err)
-			return
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", c.config.Cacert)
+		}
+	}
+	return &tlsConfig, nil
+}
+
+func (c *Client) password() (string, error) {
+	if c.config.PasswordPath == "" {
+		if c.config.Password != "" {
+			log.Warn("The ldap bind password is held in the config file. Please move this to vault and set `passwordPath`")
 		}
+		return c.config.Password, nil
 	}
-*/
-func connect() (*ldap.Conn, error) {
-	conn, err := ldap.Dial("tcp", ldapServer)
 
+	if c.secrets == nil {
+		return "", fmt.Errorf("Unable to read ldap bind password, no secret reader available")
+	}
+
+	secret, err := c.secrets.ReadSecret(c.config.PasswordPath)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to connect. %s", err)
+		return "", fmt.Errorf("Unable to read ldap bind password: %w", err)
 	}
 
-	if err := conn.Bind(ldapBind, ldapPassword); err != nil {
-		return nil, fmt.Errorf("Failed to bind. %s", err)
+	password, ok := secret["password"]
+	if !ok {
+		return "", fmt.Errorf("No password found at %s", c.config.PasswordPath)
 	}
+	return password, nil
+}
 
-	return conn, nil
+// Find the account for an email address or username
+//
+// Returns nil if no account exists.
+func (c *Client) Find(username string) (*Account, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return c.find(conn, username)
 }
 
-func list(conn *ldap.Conn) error {
+func (c *Client) find(conn *ldap.Conn, username string) (*Account, error) {
 	result, err := conn.Search(ldap.NewSearchRequest(
-		baseDN,
+		c.config.BaseDN,
 		ldap.ScopeWholeSubtree,
 		ldap.NeverDerefAliases,
 		0,
 		0,
 		false,
-		filter("*"),
-		[]string{"dn", "sAMAccountName", "mail", "sn", "givenName"},
+		c.filter(username),
+		[]string{"dn", "sAMAccountName", "uid", "mail", "displayName", "cn", "memberOf", c.config.DisabledAttribute},
 		nil,
 	))
 
 	if err != nil {
-		return fmt.Errorf("Failed to search users. %s", err)
+		return nil, fmt.Errorf("Failed to search for %s: %w", username, err)
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, nil
 	}
 
-	for _, entry := range result.Entries {
-		fmt.Printf(
-			"%s: %s %s -- %v -- %v\n",
-			entry.DN,
-			entry.GetAttributeValue("givenName"),
-			entry.GetAttributeValue("sn"),
-			entry.GetAttributeValue("sAMAccountName"),
-			entry.GetAttributeValue("mail"),
-		)
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("Found %d accounts for %s", len(result.Entries), username)
 	}
 
-	return nil
+	entry := result.Entries[0]
+	account := Account{
+		DN:       entry.DN,
+		Username: first(entry.GetAttributeValue("sAMAccountName"), entry.GetAttributeValue("uid")),
+		Email:    entry.GetAttributeValue("mail"),
+		Name:     first(entry.GetAttributeValue("displayName"), entry.GetAttributeValue("cn")),
+		Disabled: c.disabled(entry),
+		Groups:   entry.GetAttributeValues("memberOf"),
+	}
+	return &account, nil
 }
 
-func auth(conn *ldap.Conn) error {
-	result, err := conn.Search(ldap.NewSearchRequest(
-		baseDN,
-		ldap.ScopeWholeSubtree,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		filter(loginUsername),
-		[]string{"dn"},
-		nil,
-	))
+// Authenticate an account by binding as it
+//
+// Disabled accounts are refused even if the directory accepts the bind.
+func (c *Client) Authenticate(username, password string) (*Account, error) {
+	// An empty password is an unauthenticated bind which
+	// many directories accept for any DN
+	if password == "" {
+		return nil, fmt.Errorf("A password is required")
+	}
 
+	conn, err := c.connect()
 	if err != nil {
-		return fmt.Errorf("Failed to find user. %s", err)
+		return nil, err
 	}
+	defer conn.Close()
 
-	if len(result.Entries) < 1 {
-		return fmt.Errorf("User does not exist")
+	account, err := c.find(conn, username)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(result.Entries) > 1 {
-		return fmt.Errorf("Too many entries returned")
+	if account == nil {
+		return nil, fmt.Errorf("No account found for %s", username)
 	}
 
-	if err := conn.Bind(result.Entries[0].DN, loginPassword); err != nil {
-		fmt.Printf("Failed to auth. %s", err)
-	} else {
-		fmt.Printf("Authenticated successfuly!")
+	if account.Disabled {
+		return nil, fmt.Errorf("The account for %s is disabled", username)
 	}
 
-	return nil
+	if err := conn.Bind(account.DN, password); err != nil {
+		return nil, fmt.Errorf("Failed to authenticate %s: %w", username, err)
+	}
+	return account, nil
 }
 
-func filter(needle string) string {
-	res := strings.Replace(
-		filterDN,
-		"{username}",
-		needle,
-		-1,
-	)
+// Check if an entry is marked as disabled
+func (c *Client) disabled(entry *ldap.Entry) bool {
+	values := entry.GetAttributeValues(c.config.DisabledAttribute)
+	if strings.EqualFold(c.config.DisabledAttribute, config.LDAP_AD_DISABLED_ATTRIBUTE) {
+		for _, v := range values {
+			if flags, err := strconv.ParseInt(v, 10, 64); err == nil && flags&AD_ACCOUNTDISABLE != 0 {
+				return true
+			}
+		}
+		return false
+	}
 
-	return res
+	if c.config.DisabledValue == "" {
+		return len(values) > 0
+	}
+
+	for _, v := range values {
+		if strings.EqualFold(v, c.config.DisabledValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) filter(username string) string {
+	return strings.ReplaceAll(c.config.FilterDN, "{username}", ldap.EscapeFilter(username))
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/grafana/loki/pkg/logcli/client"
@@ -29,7 +31,9 @@ import (
 	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/grafana/loki/pkg/logqlmodel"
+	"github.com/notapipeline/thor/pkg/audit"
 	"github.com/notapipeline/thor/pkg/config"
+	promconfig "github.com/prometheus/common/config"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -37,27 +41,12 @@ const (
 	BATCH_SIZE int = 1000
 	LIMIT      int = 10000
 
-	// duration is for the last year
+	// Searches with no start cover the last year
 	DURATION int64 = int64(time.Hour) * 168 * 52
 )
 
-var (
-	ignoreWords []string = []string{
-		"delete",
-		"destroy",
-		"undelete",
-		"metadata",
-	}
-
-	ignorePaths []string = []string{
-		"sys",
-	}
-)
-
-type Result struct {
-	Namespace string
-	Paths     []string
-}
+// Kept for compatibility, results are shared by all audit sources
+type Result = audit.Result
 
 type SimpleMessage struct {
 	Time    string `json:"time"`
@@ -65,159 +54,331 @@ type SimpleMessage struct {
 	Host    string `json:"host"`
 }
 
-func (r *Result) Contains(what string) bool {
-	for _, p := range r.Paths {
-		if p == what {
-			return true
-		}
-	}
-	return false
-}
-
 type streamEntryPair struct {
 	entry  loghttp.Entry
 	labels loghttp.LabelSet
 }
 
 type Loki struct {
-	client *client.DefaultClient
+	client    *client.DefaultClient
+	config    *config.LokiConfig
+	template  *template.Template
+	chunkSize time.Duration
+}
+
+// Values the search query templates are rendered with
+type queryValues struct {
+	Pattern string
+	Literal string
+}
+
+// Reads secrets held in Vault
+//
+// Used to look up the Loki credentials at runtime so they
+// never need to be written into the config file.
+type SecretReader interface {
+	ReadSecret(path string) (map[string]string, error)
 }
 
-func NewLoki(c *config.LokiConfig) (*Loki, error) {
+func NewLoki(c *config.LokiConfig, secrets SecretReader) (*Loki, error) {
+	if c.Query == nil {
+		c.Configure()
+	}
+
+	tpl, err := template.New("query").Parse(fmt.Sprintf("%s %s", c.Query.Selector, c.Query.Pipeline))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid loki query template: %w", err)
+	}
+
+	chunkSize, err := time.ParseDuration(c.Query.ChunkSize)
+	if err != nil || chunkSize <= 0 {
+		return nil, fmt.Errorf("Invalid loki chunk size %q", c.Query.ChunkSize)
+	}
+
+	var scheme string = "http"
+	if c.TLS != nil {
+		scheme = "https"
+	}
+
 	loki := Loki{
 		client: &client.DefaultClient{
-			Address:  fmt.Sprintf("http://%s:%d", c.Server, c.Port),
+			Address:  fmt.Sprintf("%s://%s:%d", scheme, c.Server, c.Port),
+			OrgID:    c.OrgID,
 			Username: c.Username,
 			Password: c.Password,
 		},
+		config:    c,
+		template:  tpl,
+		chunkSize: chunkSize,
+	}
+
+	if c.TLS != nil {
+		loki.client.TLSConfig = promconfig.TLSConfig{
+			CAFile:             c.TLS.Cacert,
+			CertFile:           c.TLS.Cert,
+			KeyFile:            c.TLS.Key,
+			ServerName:         c.TLS.ServerName,
+			InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+		}
+	}
+
+	if c.CredentialsPath != "" {
+		if secrets == nil {
+			return nil, fmt.Errorf("Unable to read loki credentials, no secret reader available")
+		}
+
+		credentials, err := secrets.ReadSecret(c.CredentialsPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read loki credentials: %w", err)
+		}
+
+		loki.client.Username = credentials["username"]
+		loki.client.Password = credentials["password"]
+		loki.client.BearerToken = credentials["token"]
+		if loki.client.BearerToken != "" && (loki.client.Username != "" || loki.client.Password != "") {
+			return nil, fmt.Errorf("Loki credentials at %s must hold either a token or a username and password", c.CredentialsPath)
+		}
+	} else if c.Username != "" || c.Password != "" {
+		log.Warn("Loki credentials are held in the config file. Please move these to vault and set `credentialsPath`")
 	}
-	//
 	return &loki, nil
 }
 
-func (loki *Loki) Search(user string, results *[]Result) error {
-	defaultEnd := time.Now()
-	since := time.Duration(DURATION)
-	defaultStart := defaultEnd.Add(-since)
-
-	// For vault audit logs, we can use a simplified loki search string
-	// to simply regex for the user.
-	//
-	// Validation on the user email must be done at a higher level to
-	// protect the search query from abuse.
-	queryString := fmt.Sprintf("{active=\"true\"} |~ \".*%s*\" |= \"type=response\" | logfmt", user)
-	searchQuery := &query.Query{
-		QueryString: queryString,
-		Start:       defaultStart,
-		End:         defaultEnd,
-		BatchSize:   BATCH_SIZE,
-		Limit:       LIMIT,
-	}
-
-	return loki.search(searchQuery, results)
+// Build the LogQL query used to search for `identity`
+//
+// The user searched for must be an email address or username. Every
+// identifier is escaped before being rendered into the configured
+// query templates.
+func (loki *Loki) Query(identity *audit.Identity) (string, error) {
+	if err := audit.ValidateUser(identity.User); err != nil {
+		return "", err
+	}
+
+	patterns := make([]string, 0)
+	for _, identifier := range identity.Identifiers() {
+		patterns = append(patterns, regexp.QuoteMeta(identifier))
+	}
+
+	var buffer strings.Builder
+	if err := loki.template.Execute(&buffer, queryValues{
+		Pattern: strconv.Quote(strings.Join(patterns, "|")),
+		Literal: strconv.Quote(identity.User),
+	}); err != nil {
+		return "", fmt.Errorf("Unable to build loki query: %w", err)
+	}
+	return buffer.String(), nil
 }
 
-func (loki *Loki) search(q *query.Query, results *[]Result) (err error) {
+// Search the vault audit logs for paths accessed by `identity` during `window`
+//
+// Where no start is given the last year is searched and the start
+// used reported in the summary. The window is
+// queried in chunks, newest first, so each chunk stays within the
+// range Loki accepts. A chunk reaching the limit marks the search as
+// truncated and the remaining chunks are still searched.
+func (loki *Loki) Search(identity *audit.Identity, window audit.Window, results *[]Result) (audit.Summary, error) {
+	var summary audit.Summary
+
+	queryString, err := loki.Query(identity)
+	if err != nil {
+		return summary, err
+	}
+	summary.Query = queryString
+
+	end := window.End
+	if end.IsZero() || end.After(time.Now()) {
+		end = time.Now()
+	}
+
+	start := window.Start
+	if start.IsZero() {
+		start = end.Add(-time.Duration(DURATION))
+		summary.Since = start
+	}
+
+	for end.After(start) {
+		chunkStart := end.Add(-loki.chunkSize)
+		if chunkStart.Before(start) {
+			chunkStart = start
+		}
+
+		searchQuery := &query.Query{
+			QueryString: queryString,
+			Start:       chunkStart,
+			End:         end,
+			BatchSize:   BATCH_SIZE,
+			Limit:       loki.config.Query.Limit,
+		}
+
+		truncated, err := loki.search(searchQuery, identity, results)
+		if err != nil {
+			return summary, err
+		}
+
+		if truncated {
+			log.Warnf("Loki search for %s truncated between %s and %s", identity.User,
+				chunkStart.Format(time.RFC3339), end.Format(time.RFC3339))
+			summary.Truncated = true
+		}
+		end = chunkStart
+	}
+	return summary, nil
+}
+
+func (loki *Loki) search(q *query.Query, identity *audit.Identity, results *[]Result) (truncated bool, err error) {
 
 	var entries []streamEntryPair
 	{
-		if entries, err = loki.query(q); err != nil {
+		if entries, truncated, err = loki.query(q); err != nil {
 			err = fmt.Errorf("search: %w", err)
 			return
 		}
 	}
 
 	for _, entry := range entries {
-		var (
-			requestEntry  map[string]any    = make(map[string]any)
-			responseEntry map[string]any    = make(map[string]any)
-			labels        map[string]string = entry.labels.Map()
-			s             string
-		)
-
-		s = strings.ReplaceAll(labels["request"], "=>", ":")
-		s = strings.ReplaceAll(s, "nil", "null")
-
-		if err = json.Unmarshal([]byte(s), &requestEntry); err != nil {
-			err = fmt.Errorf("JSON UNPACK: %w", err)
+		e, err := loki.auditEntry(entry)
+		if err != nil {
 			log.Error(err)
 			continue
 		}
 
-		s = strings.ReplaceAll(labels["response"], "=>", ":")
-		s = strings.ReplaceAll(s, "nil", "null")
-
-		if err = json.Unmarshal([]byte(s), &responseEntry); err != nil {
-			err = fmt.Errorf("JSON UNPACK: %w", err)
-			log.Error(err)
+		// The query matches identifiers anywhere in the line so
+		// confirm the entry was made by the person where possible
+		if len(e.Identities()) > 0 && !identity.Made(e) {
 			continue
 		}
 
-		if data, ok := responseEntry["data"]; ok {
-			paths := make([]string, 0)
-			for k := range data.(map[string]interface{}) {
+		if p, operation, ok := e.Access(); ok {
+			// Loki entries carry their own timestamp
+			var access audit.Access
+			access.Add(entry.entry.Timestamp, operation)
+			audit.Add(results, e.Request.Namespace.Path, p, access)
+		}
+	}
 
-				var pathSegments []string = strings.Split(k, "/")
-				if len(pathSegments) > 1 && k[len(k)-1:] != "/" {
-					for _, ignore := range ignoreWords {
-						if pathSegments[1] == ignore {
-							pathSegments[1] = "data"
-						}
-					}
+	return
+}
 
-					var ignore bool = false
-					for _, ignorePath := range ignorePaths {
-						if pathSegments[0] == ignorePath {
-							ignore = true
-						}
-					}
+// Build the audit entry a log line was shipped from
+//
+// Lines shipped unmodified are the JSON audit entry. Otherwise the
+// entry is rebuilt from the request and response labels extracted by
+// the query pipeline, which may hold either JSON or Ruby hashes as
+// written by fluentd.
+func (loki *Loki) auditEntry(pair streamEntryPair) (*audit.Entry, error) {
+	if line := strings.TrimSpace(pair.entry.Line); strings.HasPrefix(line, "{") {
+		if e, err := audit.ParseEntry([]byte(line)); err == nil && e.Type != "" {
+			return e, nil
+		}
+	}
 
-					if !ignore {
-						paths = append(paths, strings.Join(pathSegments, "/"))
-					}
-				}
-			}
+	var (
+		labels map[string]string = pair.labels.Map()
+		e      audit.Entry       = audit.Entry{
+			Type:  labels["type"],
+			Time:  labels["time"],
+			Error: labels["error"],
+		}
+	)
 
-			if len(paths) == 0 {
-				continue
-			}
+	if e.Type == "" {
+		e.Type = audit.ENTRY_RESPONSE
+	}
 
-			for _, path := range paths {
-				namespace := requestEntry["namespace"].(map[string]any)["path"]
-				if namespace != nil && len(strings.Split(path, "/")) > 1 {
-
-					var skipAddNamespace bool = false
-					{
-						for i, v := range *results {
-							if v.Namespace == strings.Trim(namespace.(string), "/") {
-								if !v.Contains(path) {
-									(*results)[i].Paths = append(v.Paths, path)
-								}
-								skipAddNamespace = true
-							}
-						}
-					}
+	if err := unmarshalLabel(labels[loki.config.Query.RequestLabel], &e.Request); err != nil {
+		return nil, fmt.Errorf("Invalid %s label: %w", loki.config.Query.RequestLabel, err)
+	}
 
-					if !skipAddNamespace {
-						result := Result{
-							Namespace: strings.Trim(namespace.(string), "/"),
-							Paths:     make([]string, 0),
-						}
-						result.Paths = append(result.Paths, path)
-						*results = append(*results, result)
-					}
-				}
+	if v, ok := labels[loki.config.Query.ResponseLabel]; ok {
+		e.Response = &audit.Response{}
+		if err := unmarshalLabel(v, e.Response); err != nil {
+			return nil, fmt.Errorf("Invalid %s label: %w", loki.config.Query.ResponseLabel, err)
+		}
+	}
+
+	if v, ok := labels["auth"]; ok {
+		if err := unmarshalLabel(v, &e.Auth); err != nil {
+			return nil, fmt.Errorf("Invalid auth label: %w", err)
+		}
+	}
+	return &e, nil
+}
+
+func unmarshalLabel(value string, v any) error {
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(hashToJSON(value)), v)
+}
+
+// Convert a Ruby hash to JSON
+//
+// `=>` and `nil` are only replaced outside of quoted strings so
+// values containing them are left intact. JSON is returned as is.
+func hashToJSON(s string) string {
+	var (
+		out      strings.Builder
+		inString bool
+		escaped  bool
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
 			}
+			continue
 		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case strings.HasPrefix(s[i:], "=>"):
+			out.WriteByte(':')
+			i++
+			continue
+		case strings.HasPrefix(s[i:], "nil") && !isWord(s, i-1) && !isWord(s, i+3):
+			out.WriteString("null")
+			i += 2
+			continue
+		}
+		out.WriteByte(c)
 	}
+	return out.String()
+}
 
-	return nil
+func isWord(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+	c := s[i]
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
 }
 
-func (loki *Loki) ApplicationLogs(hosts []string, result *chan SimpleMessage, done chan bool) error {
-	queryString := `{thorhost=~"` + strings.Join(hosts, "|") + `"} | logfmt | line_format ` + "`{{" +
+// Build the LogQL query for the Thor agent logs of `hosts`
+//
+// Host names come from secret paths so are escaped
+// before being used in the query
+func applicationQuery(hosts []string) string {
+	patterns := make([]string, 0)
+	for _, host := range hosts {
+		patterns = append(patterns, regexp.QuoteMeta(host))
+	}
+
+	return `{thorhost=~` + strconv.Quote(strings.Join(patterns, "|")) + `} | logfmt | line_format ` + "`{{" +
 		` .MESSAGE | replace "\\" "" ` + "}}`" +
 		` | logfmt | _EXE=~".*thor" or ProviderName="thor.exe" | __error__ =""`
+}
+
+func (loki *Loki) ApplicationLogs(hosts []string, result *chan SimpleMessage, done chan bool) error {
+	var queryString string = applicationQuery(hosts)
 
 	end := time.Now()
 	start := end.Add(-time.Duration(5 * time.Second))
@@ -285,7 +446,7 @@ func (loki *Loki) ApplicationLogs(hosts []string, result *chan SimpleMessage, do
 func (loki *Loki) getLogMessage(q *query.Query) (results []SimpleMessage, err error) {
 	var entries []streamEntryPair
 	{
-		if entries, err = loki.query(q); err != nil {
+		if entries, _, err = loki.query(q); err != nil {
 			err = fmt.Errorf("getLogMessage: %w", err)
 			return
 		}
@@ -324,7 +485,9 @@ func (loki *Loki) getLogMessage(q *query.Query) (results []SimpleMessage, err er
 // https://github.com/grafana/loki/blob/main/pkg/logcli/query/query.go
 // as this is the simplest form I can understand to interact with the
 // loki query mechanism...
-func (loki *Loki) query(q *query.Query) (entries []streamEntryPair, err error) {
+//
+// Reports if the limit was reached before all entries in the range were read.
+func (loki *Loki) query(q *query.Query) (entries []streamEntryPair, truncated bool, err error) {
 	entries = make([]streamEntryPair, 0)
 	var (
 		resultLength int
@@ -339,11 +502,15 @@ func (loki *Loki) query(q *query.Query) (entries []streamEntryPair, err error) {
 		direction = logproto.FORWARD
 	}
 
+	// One entry more than the limit is read so a range holding
+	// exactly `Limit` entries is not reported as truncated
+	var limit int = q.Limit + 1
+
 	log.Debugf("Entering search loop 1 with %d, %d", total, q.Limit)
-	for total < q.Limit {
+	for total < limit {
 		bs := q.BatchSize
-		if q.Limit-total < q.BatchSize {
-			bs = q.Limit - total + len(lastEntry)
+		if limit-total < q.BatchSize {
+			bs = limit - total + len(lastEntry)
 		}
 
 		var resp *loghttp.QueryResponse
@@ -372,8 +539,8 @@ func (loki *Loki) query(q *query.Query) (entries []streamEntryPair, err error) {
 			break
 		}
 
-		if resultLength == q.Limit {
-			log.Warn("Result limit hit")
+		total += resultLength
+		if total >= limit {
 			break
 		}
 
@@ -386,13 +553,16 @@ func (loki *Loki) query(q *query.Query) (entries []streamEntryPair, err error) {
 			return
 		}
 
-		total += resultLength
 		if q.Forward {
 			start = lastEntry[0].Timestamp
 		} else {
 			end = lastEntry[0].Timestamp.Add(1 * time.Nanosecond)
 		}
 	}
+
+	if len(entries) > q.Limit {
+		entries, truncated = entries[:q.Limit], true
+	}
 	return
 }
 
@@ -457,3 +627,27 @@ func (loki *Loki) parseStreams(streams loghttp.Streams, entries *[]streamEntryPa
 	}
 	return length, lel
 }
+
+// Searches the vault audit logs held in Loki
+//
+// A new client is created for each search so credentials
+// held in vault are always current.
+type Source struct {
+	config  *config.LokiConfig
+	secrets SecretReader
+}
+
+func NewSource(c *config.LokiConfig, secrets SecretReader) *Source {
+	return &Source{
+		config:  c,
+		secrets: secrets,
+	}
+}
+
+func (s *Source) Search(identity *audit.Identity, window audit.Window, results *[]Result) (audit.Summary, error) {
+	l, err := NewLoki(s.config, s.secrets)
+	if err != nil {
+		return audit.Summary{}, err
+	}
+	return l.Search(identity, window, results)
+}
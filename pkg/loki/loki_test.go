@@ -0,0 +1,113 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/pkg/logcli/client"
+	"github.com/grafana/loki/pkg/logcli/query"
+)
+
+// Serve `count` entries a second apart, newest first, honouring
+// the limit and range of each query
+func fakeLoki(t *testing.T, base time.Time, count int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			values   = r.URL.Query()
+			limit, _ = strconv.Atoi(values.Get("limit"))
+			start, _ = strconv.ParseInt(values.Get("start"), 10, 64)
+			end, _   = strconv.ParseInt(values.Get("end"), 10, 64)
+			entries  = make([][]string, 0)
+		)
+
+		for i := 0; i < count; i++ {
+			ts := base.Add(time.Duration(i) * time.Second).UnixNano()
+			if ts >= start && ts < end {
+				entries = append(entries, []string{strconv.FormatInt(ts, 10), fmt.Sprintf("line %d", i)})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i][0] > entries[j][0] })
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "streams",
+				"result": []interface{}{
+					map[string]interface{}{
+						"stream": map[string]string{"job": "vault"},
+						"values": entries,
+					},
+				},
+			},
+		})
+	}))
+}
+
+func TestQueryTruncated(t *testing.T) {
+	var base time.Time = time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		count     int
+		limit     int
+		batch     int
+		expected  int
+		truncated bool
+	}{
+		{"under the limit", 5, 10, 3, 5, false},
+		{"exactly the limit", 10, 10, 3, 10, false},
+		{"exactly the limit in one batch", 10, 10, 10, 10, false},
+		{"over the limit", 11, 10, 3, 10, true},
+		{"over the limit in one batch", 20, 10, 100, 10, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := fakeLoki(t, base, tt.count)
+			defer server.Close()
+
+			loki := &Loki{client: &client.DefaultClient{Address: server.URL}}
+			entries, truncated, err := loki.query(&query.Query{
+				QueryString: `{job="vault"}`,
+				Start:       base.Add(-time.Minute),
+				End:         time.Now(),
+				Limit:       tt.limit,
+				BatchSize:   tt.batch,
+				Quiet:       true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != tt.expected || truncated != tt.truncated {
+				t.Errorf("expected %d entries truncated %t, got %d truncated %t",
+					tt.expected, tt.truncated, len(entries), truncated)
+			}
+		})
+	}
+}
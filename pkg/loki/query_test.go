@@ -0,0 +1,99 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package loki
+
+import (
+	"testing"
+
+	"github.com/notapipeline/thor/pkg/audit"
+	"github.com/notapipeline/thor/pkg/config"
+)
+
+func TestQueryEscapesIdentifiers(t *testing.T) {
+	loki, err := NewLoki(&config.LokiConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		names    []string
+		expected string
+	}{
+		{
+			"email",
+			"j.doe@example.com",
+			nil,
+			`{active="true"} |~ "j\\.doe@example\\.com" |= "type=response" | logfmt`,
+		},
+		{
+			"aliases",
+			"jdoe",
+			[]string{"ldap-jdoe", "j+doe"},
+			`{active="true"} |~ "jdoe|ldap-jdoe|j\\+doe" |= "type=response" | logfmt`,
+		},
+		{
+			"breaking out of the pattern",
+			"jdoe",
+			[]string{`x" |= "y`, `.*`},
+			`{active="true"} |~ "jdoe|x\" \\|= \"y|\\.\\*" |= "type=response" | logfmt`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := audit.NewIdentity(tt.user)
+			for _, name := range tt.names {
+				identity.AddName(name)
+			}
+
+			query, err := loki.Query(identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, query)
+			}
+		})
+	}
+
+	if _, err := loki.Query(audit.NewIdentity(`jdoe" or "1`)); err == nil {
+		t.Error("expected an invalid user to be refused")
+	}
+}
+
+func TestApplicationQueryEscapesHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []string
+		expected string
+	}{
+		{"single host", []string{"web.example.com"}, `{thorhost=~"web\\.example\\.com"}`},
+		{"several hosts", []string{"web01", "db01"}, `{thorhost=~"web01|db01"}`},
+		{"quotes and selectors", []string{`a"} |= "b`, "c|d"}, `{thorhost=~"a\"\\} \\|= \"b|c\\|d"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := applicationQuery(tt.hosts)
+			if selector := query[:len(tt.expected)]; selector != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, selector)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Sign in with an OpenID Connect provider
+//
+// Implements the authorization code flow with PKCE. ID tokens are
+// verified against the signing keys published by the provider.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/notapipeline/thor/pkg/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	DISCOVERY_PATH = "/.well-known/openid-configuration"
+
+	// Allowed difference between our clock and the provider
+	CLOCK_SKEW = time.Minute
+
+	// How long provider metadata and keys are cached for
+	CACHE_TTL = time.Hour
+
+	// Shortest time between fetching the signing keys for
+	// tokens signed with an unknown key
+	KEYS_REFRESH = time.Minute
+)
+
+// Reads secrets held in Vault
+type SecretReader interface {
+	ReadSecret(path string) (map[string]string, error)
+}
+
+// Provider metadata published at the discovery endpoint
+type discovery struct {
+	Issuer           string   `json:"issuer"`
+	AuthEndpoint     string   `json:"authorization_endpoint"`
+	TokenEndpoint    string   `json:"token_endpoint"`
+	JwksURI          string   `json:"jwks_uri"`
+	SigningAlgs      []string `json:"id_token_signing_alg_values_supported"`
+	ChallengeMethods []string `json:"code_challenge_methods_supported"`
+}
+
+type Provider struct {
+	config   *config.OidcConfig
+	redirect string
+	secrets  SecretReader
+	client   *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        *jose.JSONWebKeySet
+	fetched     time.Time
+	keysFetched time.Time
+}
+
+// The claims of a verified ID token
+type Claims map[string]interface{}
+
+func NewProvider(c *config.OidcConfig, redirect string, secrets SecretReader) *Provider {
+	return &Provider{
+		config:   c,
+		redirect: redirect,
+		secrets:  secrets,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Generate a random value for the state, nonce or PKCE verifier
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Get the URL to send the user to for sign in
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	oauth, err := p.oauth(false)
+	if err != nil {
+		return "", err
+	}
+
+	return oauth.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", challenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+// Exchange an authorization code for a verified set of ID token claims
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	oauth, err := p.oauth(true)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := oauth.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to exchange authorization code: %w", err)
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, fmt.Errorf("No ID token returned by the provider")
+	}
+	return p.verify(raw, nonce)
+}
+
+// Build the oauth2 client configuration
+//
+// The client secret is only read from vault when it is needed
+// for the token exchange so it is always current.
+func (p *Provider) oauth(exchange bool) (*oauth2.Config, error) {
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	oauth := oauth2.Config{
+		ClientID:    p.config.ClientID,
+		RedirectURL: p.redirect,
+		Scopes:      p.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+
+	if exchange && p.config.ClientSecretPath != "" {
+		if p.secrets == nil {
+			return nil, fmt.Errorf("Unable to read oidc client secret, no secret reader available")
+		}
+
+		secret, err := p.secrets.ReadSecret(p.config.ClientSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read oidc client secret: %w", err)
+		}
+
+		if oauth.ClientSecret = secret["clientSecret"]; oauth.ClientSecret == "" {
+			return nil, fmt.Errorf("No clientSecret found at %s", p.config.ClientSecretPath)
+		}
+	}
+	return &oauth, nil
+}
+
+// Get the provider metadata, discovering it if not cached
+func (p *Provider) metadata() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.fetched) < CACHE_TTL {
+		return p.discovery, nil
+	}
+
+	// The issuer is compared exactly as configured, a trailing slash
+	// is only dropped when building the discovery url
+	var d discovery
+	if err := p.get(strings.TrimSuffix(p.config.Issuer, "/")+DISCOVERY_PATH, &d); err != nil {
+		return nil, fmt.Errorf("Failed to discover oidc provider: %w", err)
+	}
+
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("Provider issuer %q does not match the configured issuer", d.Issuer)
+	}
+
+	if d.AuthEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, fmt.Errorf("Provider metadata is incomplete")
+	}
+
+	if len(d.ChallengeMethods) > 0 && !slices.Contains(d.ChallengeMethods, "S256") {
+		return nil, fmt.Errorf("Provider does not support PKCE with S256")
+	}
+
+	p.discovery, p.keys, p.fetched = &d, nil, time.Now()
+	return p.discovery, nil
+}
+
+// Get the provider signing keys, refreshing them if `kid` is not known
+//
+// Keys are refreshed at most once every KEYS_REFRESH so tokens naming
+// unknown keys cannot be used to make Thor call the provider repeatedly.
+func (p *Provider) keySet(d *discovery, kid string) (*jose.JSONWebKeySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && (kid == "" || len(p.keys.Key(kid)) > 0 || time.Since(p.keysFetched) < KEYS_REFRESH) {
+		return p.keys, nil
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := p.get(d.JwksURI, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to fetch provider keys: %w", err)
+	}
+	p.keys, p.keysFetched = &keys, time.Now()
+	return p.keys, nil
+}
+
+func (p *Provider) get(url string, v any) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// Verify the signature and claims of an ID token
+func (p *Provider) verify(raw, nonce string) (Claims, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ID token: %w", err)
+	}
+
+	if len(token.Headers) != 1 {
+		return nil, fmt.Errorf("Invalid ID token: expected a single signature")
+	}
+
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	var header jose.Header = token.Headers[0]
+	if !allowedAlgorithm(d, header.Algorithm) {
+		return nil, fmt.Errorf("Invalid ID token: algorithm %s is not allowed", header.Algorithm)
+	}
+
+	keys, err := p.keySet(d, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := keys.Keys
+	if header.KeyID != "" {
+		candidates = keys.Key(header.KeyID)
+	}
+
+	var (
+		standard jwt.Claims
+		claims   Claims
+		verified bool
+	)
+	for _, key := range candidates {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if err := token.Claims(key.Key, &standard, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("Invalid ID token: signature could not be verified")
+	}
+
+	if err := standard.ValidateWithLeeway(jwt.Expected{
+		Issuer:   p.config.Issuer,
+		Audience: jwt.Audience{p.config.ClientID},
+		Time:     time.Now(),
+	}, CLOCK_SKEW); err != nil {
+		return nil, fmt.Errorf("Invalid ID token: %w", err)
+	}
+
+	if standard.Expiry == nil {
+		return nil, fmt.Errorf("Invalid ID token: no expiry")
+	}
+
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return nil, fmt.Errorf("Invalid ID token: nonce does not match")
+	}
+	return claims, nil
+}
+
+// Only asymmetric algorithms advertised by the provider are accepted
+func allowedAlgorithm(d *discovery, alg string) bool {
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512,
+		jose.ES256, jose.ES384, jose.ES512, jose.EdDSA:
+	default:
+		return false
+	}
+
+	if d == nil || len(d.SigningAlgs) == 0 {
+		return alg == string(jose.RS256)
+	}
+	return slices.Contains(d.SigningAlgs, alg)
+}
+
+// Get a string claim
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Get a claim holding a list of strings
+//
+// A single string is returned as a list of one.
+func (c Claims) Strings(name string) []string {
+	values := make([]string, 0)
+	switch v := c[name].(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
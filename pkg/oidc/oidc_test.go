@@ -0,0 +1,82 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package oidc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/notapipeline/thor/pkg/config"
+)
+
+func TestAllowedAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		d       *discovery
+		alg     string
+		allowed bool
+	}{
+		{"default rs256", nil, "RS256", true},
+		{"default others", nil, "ES256", false},
+		{"advertised", &discovery{SigningAlgs: []string{"RS256", "ES256"}}, "ES256", true},
+		{"not advertised", &discovery{SigningAlgs: []string{"RS256"}}, "PS256", false},
+		{"symmetric", &discovery{SigningAlgs: []string{"HS256"}}, "HS256", false},
+		{"none", &discovery{SigningAlgs: []string{"none"}}, "none", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := allowedAlgorithm(tt.d, tt.alg); allowed != tt.allowed {
+				t.Errorf("expected %t", tt.allowed)
+			}
+		})
+	}
+}
+
+func TestKeySetRefreshIsLimited(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+
+	var (
+		p *Provider  = NewProvider(&config.OidcConfig{}, "", nil)
+		d *discovery = &discovery{JwksURI: server.URL}
+	)
+	for i := 0; i < 5; i++ {
+		if _, err := p.keySet(d, "unknown"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected keys to be fetched once, fetched %d times", n)
+	}
+
+	p.keysFetched = time.Now().Add(-KEYS_REFRESH)
+	if _, err := p.keySet(d, "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("expected keys to be refreshed, fetched %d times", n)
+	}
+}
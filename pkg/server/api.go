@@ -18,6 +18,7 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -40,6 +41,7 @@ const (
 	DEVICES_TABLE      = "devices"
 	CERTIFICATES_TABLE = "certificates"
 	EX_EMPLOYEES_TABLE = "ex-employees"
+	JOBS_TABLE         = "jobs"
 	SHASUM             = "shasum"
 	AGENT_PORT         = 7468
 )
@@ -51,6 +53,7 @@ func (server *Server) createBuckets() {
 		DEVICES_TABLE,
 		CERTIFICATES_TABLE,
 		EX_EMPLOYEES_TABLE,
+		JOBS_TABLE,
 		SHASUM,
 	}
 
@@ -80,7 +83,19 @@ func (server *Server) Decrypt(c *gin.Context) {
 		return
 	}
 
-	message := server.vault.Decrypt(request["token"].(string), request["key"].(string))
+	var ad vault.AssociatedData
+	if purpose, ok := request["purpose"].(string); ok {
+		ad.Purpose = purpose
+	}
+	if device, ok := request["device"].(string); ok {
+		ad.Device = device
+	}
+
+	message, err := server.vault.Decrypt(request["token"].(string), request["key"].(string), ad)
+	if err != nil {
+		server.reject(c, err.Error())
+		return
+	}
 	server.accept(c, message)
 }
 
@@ -228,9 +243,10 @@ func (server *Server) AddShaSum(c *gin.Context) {
 }
 
 type RegistrationRequest struct {
-	Registration string `json:"registration_request"`
-	Namespace    string `json:"namespace"`
-	ShaSum       string `json:"shasum"`
+	Registration string   `json:"registration_request"`
+	Namespace    string   `json:"namespace"`
+	ShaSum       string   `json:"shasum"`
+	Paths        []string `json:"paths"`
 }
 
 func (server *Server) Register(c *gin.Context) {
@@ -337,13 +353,21 @@ func (server *Server) Register(c *gin.Context) {
 			return fmt.Errorf("Failed to save API Key. Please try again.")
 		}
 
+		// The paths a device registers with are the only paths
+		// it will ever be issued a token for during rotation
+		var paths []byte
+		if paths, err = json.Marshal(request.Paths); err != nil {
+			log.Errorf("Failed to encode paths for %s: %v", clientIP, err)
+			return fmt.Errorf("Invalid paths in registration request")
+		}
+
 		var n *bolt.Bucket
 		n, err = tx.CreateBucketIfNotExists([]byte(request.Namespace))
 		if err != nil {
 			// non-fatal
 			log.Errorf("Error creating butcket for device registration to %s", request.Namespace)
 		}
-		err = n.Put([]byte(clientIP), []byte(""))
+		err = n.Put([]byte(clientIP), paths)
 		if err != nil {
 			// non-fatal
 			log.Errorf("Failed to store client IP in %s", request.Namespace)
@@ -389,6 +413,7 @@ type ApiResult struct {
 type TokenRequest struct {
 	Token     string   `json:"token_request"`
 	Namespace string   `json:"namespace"`
+	Job       string   `json:"job"`
 	Paths     []string `json:"paths"`
 }
 
@@ -443,8 +468,16 @@ func (server *Server) Token(c *gin.Context) {
 		return
 	}
 
+	// Tokens are only ever issued against the job which woke the agent
+	job, err := server.getJob(request.Job)
+	if err != nil || job.Namespace != request.Namespace {
+		log.Errorf("Token request from %s for unknown job %q: %v", clientIP, request.Job, err)
+		server.reject(c, "Invalid rotation job")
+		return
+	}
+
 	var token string
-	token, err = server.vault.GetToken(request.Namespace, request.Token)
+	token, err = server.vault.GetToken(job.Namespace, job.ID, clientIP, request.Token)
 	if err != nil && token != vault.STANDBY {
 		log.Errorf("%v", err)
 		server.reject(c, "Error creating token, please retry")
@@ -0,0 +1,197 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/notapipeline/thor/pkg/audit"
+	"github.com/notapipeline/thor/pkg/config"
+	"github.com/notapipeline/thor/pkg/loki"
+	log "github.com/sirupsen/logrus"
+)
+
+type AuditSearchRequest struct {
+	Email string `json:"email" form:"email"`
+	// Dates bounding the search as YYYY-MM-DD, either may be empty
+	Start string `json:"start" form:"start"`
+	End   string `json:"end" form:"end"`
+}
+
+type AuditSearchResult struct {
+	// State of the account in the directory, if configured
+	Directory string          `json:"directory,omitempty"`
+	Identity  *audit.Identity `json:"identity"`
+	Query     string          `json:"query"`
+	Truncated bool            `json:"truncated"`
+	// Earliest date searched where a source limited a search with no start
+	Since   string         `json:"since,omitempty"`
+	Results []audit.Result `json:"results"`
+}
+
+// Build the audit sources searched for ex-employees
+//
+// Where no sources are configured, Loki is used if available.
+func (server *Server) auditSources() (audit.Source, error) {
+	var sources []config.AuditSourceConfig
+	if server.config.Audit != nil {
+		sources = server.config.Audit.Sources
+
+		var paths, words []string = audit.DEFAULT_IGNORE_PATHS, audit.DEFAULT_IGNORE_WORDS
+		if server.config.Audit.IgnorePaths != nil {
+			paths = server.config.Audit.IgnorePaths
+		}
+		if server.config.Audit.IgnoreWords != nil {
+			words = server.config.Audit.IgnoreWords
+		}
+		audit.Ignore(paths, words)
+	}
+
+	if len(sources) == 0 && server.config.Loki != nil {
+		sources = []config.AuditSourceConfig{{Type: config.AUDIT_SOURCE_LOKI}}
+	}
+
+	var multi audit.MultiSource = make(audit.MultiSource, 0)
+	for _, s := range sources {
+		switch s.Type {
+		case config.AUDIT_SOURCE_LOKI:
+			if server.config.Loki == nil {
+				return nil, fmt.Errorf("Loki audit source requires loki to be configured")
+			}
+			multi = append(multi, loki.NewSource(server.config.Loki, server.vault))
+		case config.AUDIT_SOURCE_FILE:
+			file := audit.NewFileSource(s.Path)
+			file.Start()
+			multi = append(multi, file)
+		case config.AUDIT_SOURCE_ARCHIVE:
+			multi = append(multi, audit.NewArchiveSource(s.Path))
+		case config.AUDIT_SOURCE_SOCKET:
+			socket := audit.NewSocketSource(s.Address, s.Trusted, server.bolt)
+			if err := socket.Start(); err != nil {
+				return nil, err
+			}
+			multi = append(multi, socket)
+		}
+	}
+	return multi, nil
+}
+
+// Search the audit sources for paths accessed by an ex-employee
+func (server *Server) AuditSearch(c *gin.Context) {
+	request := AuditSearchRequest{}
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: fmt.Sprintf("Request bind failure %v", err),
+		})
+		return
+	}
+
+	window, err := audit.ParseWindow(request.Start, request.End)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	log.Infof("Creating ex-employee search for %s", request.Email)
+	directory, err := server.directoryStatus(request.Email)
+	if err != nil {
+		log.Errorf("Unable to check directory for %s: %v", request.Email, err)
+	}
+
+	results := make([]audit.Result, 0)
+	identity, summary, err := server.searchAudit(request.Email, window, &results)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Result{
+		Code:   http.StatusOK,
+		Result: "OK",
+		Message: AuditSearchResult{
+			Directory: directory,
+			Identity:  identity,
+			Query:     summary.Query,
+			Truncated: summary.Truncated,
+			Since:     since(summary),
+			Results:   results,
+		},
+	})
+}
+
+// Get the earliest date searched where a source limited the window
+func since(summary audit.Summary) string {
+	if summary.Since.IsZero() {
+		return ""
+	}
+	return summary.Since.Format(audit.DATE_FORMAT)
+}
+
+// Search the audit sources for everything Vault knows `user` by
+//
+// Where the identity cannot be resolved through Vault, only
+// `user` is searched for. Token accessors are only searched
+// for when `audit.resolveTokens` is set.
+func (server *Server) searchAudit(user string, window audit.Window, results *[]audit.Result) (*audit.Identity, audit.Summary, error) {
+	var tokens bool = server.config.Audit != nil && server.config.Audit.ResolveTokens
+	identity, _, err := server.vault.ResolveIdentity(user, tokens)
+	if identity == nil {
+		return nil, audit.Summary{}, err
+	}
+
+	if err != nil {
+		log.Warnf("Unable to resolve identity of %s, searching by name only: %v", user, err)
+	}
+
+	summary, err := server.audit.Search(identity, window, results)
+	server.annotate(*results)
+	audit.Rank(*results)
+	return identity, summary, err
+}
+
+// Record the replaceable keys held at each path read
+//
+// Paths Thor cannot read are ranked without them.
+func (server *Server) annotate(results []audit.Result) {
+	for _, r := range results {
+		for _, p := range r.Paths {
+			if !p.Rotatable() {
+				continue
+			}
+
+			keys, err := server.vault.ReplaceableKeys(r.Namespace, p.Path)
+			if err != nil {
+				log.Debugf("Unable to read keys at %s/%s: %v", r.Namespace, p.Path, err)
+				continue
+			}
+			p.Replaceable = keys
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BrowseRequest struct {
+	Token     string `json:"token" form:"token"`
+	Namespace string `json:"namespace" form:"namespace"`
+	Path      string `json:"path" form:"path"`
+}
+
+// Lists a single level of the vault tree for the tree browser
+//
+// The token supplied is the operators own vault token and is
+// never stored by the server.
+func (server *Server) Browse(c *gin.Context) {
+	request := BrowseRequest{}
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: fmt.Sprintf("Request bind failure %v", err),
+		})
+		return
+	}
+
+	if request.Token == "" {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: "A vault token is required to browse",
+		})
+		return
+	}
+
+	nodes, err := server.vault.Browse(request.Token, request.Namespace, request.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Result{
+			Code:    http.StatusBadRequest,
+			Result:  "Error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Result{
+		Code:    http.StatusOK,
+		Result:  "OK",
+		Message: nodes,
+	})
+}
@@ -0,0 +1,83 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notapipeline/thor/pkg/audit"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DIRECTORY_DISABLED = "disabled"
+	DIRECTORY_MISSING  = "missing"
+	DIRECTORY_ACTIVE   = "active"
+	DIRECTORY_UNKNOWN  = "unknown"
+)
+
+// Get the state of an account in the directory
+//
+// Returns an empty status when no directory is configured.
+func (server *Server) directoryStatus(user string) (string, error) {
+	if server.ldap == nil {
+		return "", nil
+	}
+
+	account, err := server.ldap.Find(user)
+	switch {
+	case err != nil:
+		return DIRECTORY_UNKNOWN, err
+	case account == nil:
+		return DIRECTORY_MISSING, nil
+	case account.Disabled:
+		return DIRECTORY_DISABLED, nil
+	}
+	return DIRECTORY_ACTIVE, nil
+}
+
+// Check that an ex-employee has really left before rotating
+//
+// Rotation is refused for an account which is still active, or whose
+// state cannot be read, unless an override reason is given. Returns
+// the override reason accepted, if one was needed.
+//
+// `user` must be a valid email address or username so a missing or
+// malformed user cannot pass as missing from the directory.
+func (server *Server) confirmLeaver(user, override string) (string, error) {
+	if err := audit.ValidateUser(user); err != nil {
+		return "", err
+	}
+
+	status, err := server.directoryStatus(user)
+	if err != nil {
+		log.Errorf("Unable to check directory for %s: %v", user, err)
+	}
+
+	if status == "" || status == DIRECTORY_DISABLED || status == DIRECTORY_MISSING {
+		return "", nil
+	}
+
+	override = strings.TrimSpace(override)
+	if override == "" {
+		return "", fmt.Errorf("The account for %s is %s in the directory. A reason is required to rotate", user, status)
+	}
+
+	log.Warnf("Rotating for %s whose account is %s in the directory: %s", user, status, override)
+	return override, nil
+}
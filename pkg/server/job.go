@@ -0,0 +1,154 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/notapipeline/thor/pkg/vault"
+	log "github.com/sirupsen/logrus"
+)
+
+// A rotation job is created each time an operator requests rotation
+//
+// The job ID is used to key the rotation credentials stored in vault
+// and is sent to each agent woken for the job so that any token
+// request can be tied back to the job it is serving.
+type Job struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace"`
+	Type      string    `json:"type"`
+	Requester string    `json:"requester"`
+	Paths     []string  `json:"paths"`
+	Created   time.Time `json:"created"`
+
+	// Access removed from an ex-employee as part of the job
+	Revocation *Revocation `json:"revocation,omitempty"`
+
+	// Why an ex-employee whose account is still active was rotated
+	Override string `json:"override,omitempty"`
+}
+
+func NewJob(namespace, jobType, requester string, paths []string) (*Job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("Unable to generate job ID: %w", err)
+	}
+
+	job := Job{
+		ID:        hex.EncodeToString(id),
+		Namespace: namespace,
+		Type:      jobType,
+		Requester: requester,
+		Paths:     paths,
+		Created:   time.Now(),
+	}
+	return &job, nil
+}
+
+// Get the details recorded against each secret rotated by the job
+func (job *Job) Rotation() vault.RotationJob {
+	var reason string
+	switch job.Type {
+	case "ex-employee":
+		reason = vault.REASON_EX_EMPLOYEE
+	case "manual":
+		reason = vault.REASON_MANUAL
+	default:
+		reason = vault.REASON_COMPROMISED
+	}
+
+	return vault.RotationJob{
+		ID:        job.ID,
+		Reason:    reason,
+		Requester: job.Requester,
+	}
+}
+
+// Store a job in the jobs table
+func (server *Server) saveJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return server.bolt.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(JOBS_TABLE))
+		if jobs == nil {
+			return fmt.Errorf("Failed to open jobs database for write")
+		}
+		return jobs.Put([]byte(job.ID), data)
+	})
+}
+
+// Get the paths each device in a namespace registered with
+//
+// Devices registered before paths were recorded return no paths
+// and will not be issued a token until they re-register.
+func (server *Server) devicePaths(namespace string) (map[string][]string, error) {
+	devices := make(map[string][]string)
+	if err := server.bolt.View(func(tx *bolt.Tx) error {
+		n := tx.Bucket([]byte(namespace))
+		if n == nil {
+			return fmt.Errorf("No devices registered in namespace %s", namespace)
+		}
+
+		return n.ForEach(func(k, v []byte) error {
+			paths := make([]string, 0)
+			if len(v) != 0 {
+				if err := json.Unmarshal(v, &paths); err != nil {
+					log.Errorf("Invalid paths stored for device %s: %v", string(k), err)
+				}
+			}
+			if len(paths) == 0 {
+				log.Warnf("Device %s has no registered paths in namespace %s", string(k), namespace)
+			}
+			devices[string(k)] = paths
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Retrieve a job from the jobs table
+func (server *Server) getJob(id string) (*Job, error) {
+	var job *Job
+	if err := server.bolt.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(JOBS_TABLE))
+		if jobs == nil {
+			return fmt.Errorf("Failed to read jobs database")
+		}
+
+		var value []byte
+		if value = jobs.Get([]byte(id)); value == nil {
+			return fmt.Errorf("No such rotation job %s", id)
+		}
+
+		job = &Job{}
+		return json.Unmarshal(value, job)
+	}); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
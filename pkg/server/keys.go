@@ -0,0 +1,103 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notapipeline/thor/pkg/config"
+	"github.com/notapipeline/thor/pkg/vault"
+	log "github.com/sirupsen/logrus"
+)
+
+// Command for rotating the Thor encryption key outside of the server
+type KeyRotator struct {
+	config *config.Config
+	vault  *vault.Vault
+}
+
+func NewKeyRotator() *KeyRotator {
+	return &KeyRotator{}
+}
+
+func (k *KeyRotator) Init() bool {
+	var err error
+	if k.config, err = config.NewConfig("config.yaml"); err != nil {
+		log.Error("Failed to load config ", err)
+		return false
+	}
+
+	if k.config.Vault == nil {
+		log.Error("No vault configuration found")
+		return false
+	}
+
+	if err = k.config.Vault.Validate(); err != nil {
+		log.Errorf("Invalid vault configuration: %v", err)
+		return false
+	}
+
+	k.vault = vault.NewVault(k.config.Vault)
+	return true
+}
+
+func (k *KeyRotator) Run() int {
+	rotation, err := k.vault.RotateEncryptionKey()
+	if rotation != nil {
+		log.Infof("Moved %d entries to key version %d", len(rotation.Moved), rotation.Version)
+		if len(rotation.Failed) > 0 {
+			log.Warnf("Failed to move %d entries: %s", len(rotation.Failed), strings.Join(rotation.Failed, ", "))
+		}
+	}
+
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// Rotate the Thor encryption key
+func (server *Server) RotateKey(c *gin.Context) {
+	if !server.isAdminSession(c) {
+		c.JSON(http.StatusForbidden, Result{
+			Code:    http.StatusForbidden,
+			Result:  "Error",
+			Message: "Only administrators may rotate the encryption key",
+		})
+		return
+	}
+
+	rotation, err := server.vault.RotateEncryptionKey()
+	if err != nil {
+		log.Error(err)
+		c.JSON(http.StatusInternalServerError, Result{
+			Code:    http.StatusInternalServerError,
+			Result:  "Error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Result{
+		Code:    http.StatusOK,
+		Result:  "OK",
+		Message: rotation,
+	})
+}
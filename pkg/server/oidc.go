@@ -0,0 +1,163 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/notapipeline/thor/pkg/config"
+	"github.com/notapipeline/thor/pkg/oidc"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OIDC_CALLBACK_PATH = "/oidc/callback"
+
+	// How long a user has to complete sign in with the provider
+	OIDC_LOGIN_TIMEOUT = 10 * time.Minute
+)
+
+// Create the OpenID Connect provider from the current configuration
+//
+// Called at start up and whenever the settings are saved.
+func (server *Server) configureOidc() {
+	server.oidc = nil
+	if !server.config.Oidc.Enabled() {
+		return
+	}
+
+	redirect := fmt.Sprintf("https://%s%s", server.config.TLS.HostName, OIDC_CALLBACK_PATH)
+	server.oidc = oidc.NewProvider(server.config.Oidc, redirect, server.vault)
+}
+
+// Start sign in with the OpenID Connect provider
+//
+// The state, nonce and PKCE verifier are held in the session until
+// the provider redirects back to the callback.
+func (server *Server) OidcLogin(c *gin.Context) {
+	if server.oidc == nil {
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		var err error
+		if values[i], err = oidc.NewSecret(); err != nil {
+			server.Error(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	redirect, err := server.oidc.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Errorf("OIDC signin failed: %v", err)
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set("OidcState", state)
+	session.Set("OidcNonce", nonce)
+	session.Set("OidcVerifier", verifier)
+	session.Set("OidcStarted", time.Now())
+	if err := session.Save(); err != nil {
+		server.Error(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// Complete sign in with the OpenID Connect provider
+//
+// The role is taken from the groups claim of the ID token. Users
+// granted no role are refused.
+func (server *Server) OidcCallback(c *gin.Context) {
+	if server.oidc == nil {
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	session := sessions.Default(c)
+	state, _ := session.Get("OidcState").(string)
+	nonce, _ := session.Get("OidcNonce").(string)
+	verifier, _ := session.Get("OidcVerifier").(string)
+	started, _ := session.Get("OidcStarted").(time.Time)
+
+	// Each login attempt may only be completed once
+	for _, key := range []string{"OidcState", "OidcNonce", "OidcVerifier", "OidcStarted"} {
+		session.Delete(key)
+	}
+	if err := session.Save(); err != nil {
+		log.Error(err)
+	}
+
+	if e := c.Query("error"); e != "" {
+		log.Warnf("OIDC signin failed: provider returned %s: %s", e, c.Query("error_description"))
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	if state == "" || c.Query("state") != state || time.Since(started) > OIDC_LOGIN_TIMEOUT {
+		log.Warn("OIDC signin failed: state is missing, invalid or expired")
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	claims, err := server.oidc.Exchange(c.Request.Context(), c.Query("code"), verifier, nonce)
+	if err != nil {
+		log.Warnf("OIDC signin failed: %v", err)
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	var (
+		email  string   = claims.String(server.config.Oidc.EmailClaim)
+		groups []string = claims.Strings(server.config.Oidc.GroupsClaim)
+	)
+
+	if email == "" {
+		log.Warnf("OIDC signin failed: no %s claim in ID token", server.config.Oidc.EmailClaim)
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	role := server.config.Oidc.Roles.Role(groups)
+	if role == "" {
+		log.Warnf("OIDC signin refused for %s: no role granted", email)
+		c.Redirect(http.StatusFound, "/signin?error=norole")
+		return
+	}
+
+	user := config.User{
+		Admin:  role == config.ROLE_ADMIN,
+		Email:  email,
+		Groups: groups,
+		Role:   role,
+	}
+
+	log.Infof("OIDC signin for %s as %s", user.Email, role)
+	if err := server.signinSession(&user, c); err != nil {
+		log.Error(err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
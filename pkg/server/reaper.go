@@ -0,0 +1,290 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gin-gonic/gin"
+	"github.com/notapipeline/thor/pkg/vault"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	REAP_INTERVAL = 15 * time.Minute
+
+	// Policies created before rotation was keyed by job are named by date
+	LEGACY_POLICY_PREFIX = "rotation-policy-"
+	LEGACY_POLICY_FORMAT = "2006-01-02-15-04"
+
+	// How long rotation jobs are kept once created
+	JOB_RETENTION = 90 * 24 * time.Hour
+)
+
+// The set of vault objects removed by a single run of the reaper
+type Reaped struct {
+	Policies map[string][]string `json:"policies"`
+	Entries  []string            `json:"entries"`
+	Jobs     int                 `json:"jobs"`
+}
+
+// Periodically remove rotation policies and secure path entries
+// which have outlived the rotation token they were created for
+func (server *Server) Reaper() {
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := server.reap(); err != nil {
+				log.Errorf("Reaper: %v", err)
+			}
+		case <-server.stop:
+			return
+		}
+	}
+}
+
+// Manually trigger the reaper
+func (server *Server) Cleanup(c *gin.Context) {
+	if !server.isAdminSession(c) {
+		c.JSON(http.StatusForbidden, Result{
+			Code:    http.StatusForbidden,
+			Result:  "Error",
+			Message: "Only administrators may run cleanup",
+		})
+		return
+	}
+
+	reaped, err := server.reap()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, Result{
+			Code:    http.StatusInternalServerError,
+			Result:  "Error",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, Result{
+		Code:    http.StatusOK,
+		Result:  "OK",
+		Message: reaped,
+	})
+}
+
+// Find and delete all Thor created policies and secure path entries
+// whose rotation token has expired.
+//
+// Each job is read again immediately before anything created for it
+// is deleted so a job started while the reaper is running is never
+// touched. Jobs older than JOB_RETENTION are then removed.
+//
+// Errors in a single namespace do not prevent the remaining
+// namespaces from being cleaned.
+func (server *Server) reap() (*Reaped, error) {
+	ttl, err := time.ParseDuration(vault.MAX_TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		namespaces map[string]bool = map[string]bool{
+			server.config.Vault.Namespace: true,
+		}
+		reaped *Reaped = &Reaped{
+			Policies: make(map[string][]string),
+			Entries:  make([]string, 0),
+		}
+		errs []string = make([]string, 0)
+	)
+
+	if err := server.bolt.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(JOBS_TABLE))
+		if jobs == nil {
+			return fmt.Errorf("Failed to read jobs database")
+		}
+
+		return jobs.ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil {
+				log.Errorf("Reaper: invalid job %s: %v", string(k), err)
+				return nil
+			}
+			namespaces[job.Namespace] = true
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	for namespace := range namespaces {
+		policies, err := server.vault.ListPolicies(namespace)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", namespace, err))
+			continue
+		}
+
+		expired := make([]string, 0)
+		for _, policy := range policies {
+			if server.expiredPolicy(policy, ttl) {
+				expired = append(expired, policy)
+			}
+		}
+
+		if len(expired) == 0 {
+			continue
+		}
+
+		if err := server.vault.DeletePolicies(namespace, expired); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", namespace, err))
+		}
+		reaped.Policies[namespace] = expired
+		log.Infof("Reaper: removed %d policies from namespace %s: %s", len(expired), namespace, strings.Join(expired, ", "))
+	}
+
+	entries, err := server.vault.SecureEntries()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("secure path: %v", err))
+	}
+
+	for _, entry := range entries {
+		known, expired, err := server.expiredJob(entry.Job, ttl)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("secure path: %v", err))
+			continue
+		}
+
+		// Entries without a creation time pre-date it being
+		// recorded and are long past their TTL
+		if expired || (!known && time.Since(entry.Created) > ttl) {
+			reaped.Entries = append(reaped.Entries, entry.Job)
+		}
+	}
+
+	if len(reaped.Entries) > 0 {
+		if err := server.vault.DeleteSecureEntries(reaped.Entries); err != nil {
+			errs = append(errs, fmt.Sprintf("secure path: %v", err))
+		} else {
+			log.Infof("Reaper: removed %d entries from the secure path: %s", len(reaped.Entries), strings.Join(reaped.Entries, ", "))
+		}
+	}
+
+	if reaped.Jobs, err = server.pruneJobs(JOB_RETENTION); err != nil {
+		errs = append(errs, fmt.Sprintf("jobs: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return reaped, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return reaped, nil
+}
+
+// Check if a job exists and has outlived `ttl`
+//
+// The job is read from the database on every call so the
+// result reflects jobs saved since the reaper started.
+func (server *Server) expiredJob(id string, ttl time.Duration) (known, expired bool, err error) {
+	err = server.bolt.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(JOBS_TABLE))
+		if jobs == nil {
+			return fmt.Errorf("Failed to read jobs database")
+		}
+
+		value := jobs.Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		job := Job{}
+		if err := json.Unmarshal(value, &job); err != nil {
+			return fmt.Errorf("invalid job %s: %w", id, err)
+		}
+		known, expired = true, time.Since(job.Created) > ttl
+		return nil
+	})
+	return known, expired, err
+}
+
+// Remove jobs created more than `retention` ago
+//
+// Returns the number of jobs removed.
+func (server *Server) pruneJobs(retention time.Duration) (int, error) {
+	var pruned int
+	err := server.bolt.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(JOBS_TABLE))
+		if jobs == nil {
+			return fmt.Errorf("Failed to open jobs database for write")
+		}
+
+		old := make([][]byte, 0)
+		if err := jobs.ForEach(func(k, v []byte) error {
+			job := Job{}
+			if err := json.Unmarshal(v, &job); err != nil || time.Since(job.Created) > retention {
+				old = append(old, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			if err := jobs.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+		return nil
+	})
+
+	if pruned > 0 {
+		log.Infof("Reaper: removed %d jobs older than %s", pruned, retention)
+	}
+	return pruned, err
+}
+
+// Check if a policy was created by Thor for a rotation token which has expired
+//
+// Policies for jobs no longer known are left in place as
+// there is no way to tell when they were created.
+func (server *Server) expiredPolicy(policy string, ttl time.Duration) bool {
+	switch {
+	case strings.HasPrefix(policy, vault.POLICY_PREFIX):
+		// Device policies are suffixed with the device after the job ID
+		job := strings.SplitN(strings.TrimPrefix(policy, vault.POLICY_PREFIX), "-", 2)[0]
+		known, expired, err := server.expiredJob(job, ttl)
+		if err != nil {
+			log.Errorf("Reaper: %v", err)
+		} else if !known {
+			log.Debugf("Reaper: leaving policy %s for unknown job %s", policy, job)
+		}
+		return expired
+	case strings.HasPrefix(policy, LEGACY_POLICY_PREFIX):
+		created, err := time.ParseInLocation(LEGACY_POLICY_FORMAT,
+			strings.TrimPrefix(policy, LEGACY_POLICY_PREFIX), time.Local)
+		if err != nil {
+			return false
+		}
+		return time.Since(created) > ttl
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/notapipeline/thor/pkg/loki"
+	"github.com/notapipeline/thor/pkg/vault"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions taken against an ex-employee's Vault access
+//
+// Each is optional and selected by the operator when rotating.
+type RevokeOptions struct {
+	DisableEntity bool
+
+	// Revoke every token issued to the person, including those
+	// they created, and all children of those tokens
+	RevokeTokens bool
+}
+
+func (o RevokeOptions) Any() bool {
+	return o.DisableEntity || o.RevokeTokens
+}
+
+// The outcome of revoking an ex-employee's access, kept with the job
+type Revocation struct {
+	User             string    `json:"user"`
+	Time             time.Time `json:"time"`
+	DisabledEntities []string  `json:"disabledEntities,omitempty"`
+	RevokedTokens    []string  `json:"revokedTokens,omitempty"`
+	RevokedChildren  []string  `json:"revokedChildren,omitempty"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+// Disable the entities of `user` and revoke their tokens as selected
+//
+// Every action is attempted, failures are recorded in the job
+// alongside what succeeded and returned.
+func (server *Server) revoke(job *Job, user string, options RevokeOptions) []error {
+	var (
+		errs       []error     = make([]error, 0)
+		revocation *Revocation = &Revocation{
+			User: user,
+			Time: time.Now(),
+		}
+	)
+
+	fail := func(err error) {
+		errs = append(errs, err)
+		revocation.Errors = append(revocation.Errors, err.Error())
+		server.jobMessage(err.Error())
+	}
+
+	// Tokens are found once and used for every revocation
+	identity, tokens, err := server.vault.ResolveIdentity(user, options.RevokeTokens)
+	if err != nil {
+		fail(fmt.Errorf("Unable to resolve identity of %s: %w", user, err))
+	} else if identity != nil && len(identity.EntityIds) == 0 {
+		fail(fmt.Errorf("No vault entity found for %s", user))
+	}
+
+	if identity != nil && len(identity.EntityIds) > 0 {
+		if options.DisableEntity {
+			for _, id := range identity.EntityIds {
+				server.jobMessage(fmt.Sprintf("Disabling entity %s", id))
+				if err := server.vault.DisableEntity(id); err != nil {
+					fail(fmt.Errorf("Failed to disable entity %s: %w", id, err))
+					continue
+				}
+				revocation.DisabledEntities = append(revocation.DisabledEntities, id)
+			}
+		}
+
+		if options.RevokeTokens {
+			// Created tokens are revoked before the login tokens they
+			// may be children of so each is reported against the
+			// right list. Tokens already gone with a revoked parent
+			// count as revoked.
+			slices.SortStableFunc(tokens, func(a, b vault.EntityToken) int {
+				switch {
+				case a.Created() == b.Created():
+					return 0
+				case a.Created():
+					return -1
+				}
+				return 1
+			})
+
+			for _, token := range tokens {
+				var revoked *[]string = &revocation.RevokedTokens
+				if token.Created() {
+					revoked = &revocation.RevokedChildren
+				}
+
+				server.jobMessage(fmt.Sprintf("Revoking token %s created at %s", token.Accessor, token.Path))
+				if err := server.vault.RevokeAccessor(token.Accessor); err != nil {
+					fail(fmt.Errorf("Failed to revoke token %s: %w", token.Accessor, err))
+					continue
+				}
+				*revoked = append(*revoked, token.Accessor)
+			}
+		}
+	}
+
+	job.Revocation = revocation
+	if err := server.saveJob(job); err != nil {
+		log.Errorf("Unable to record revocation for job %s: %v", job.ID, err)
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (server *Server) jobMessage(message string) {
+	server.logChannel <- loki.SimpleMessage{
+		Time:    time.Now().Format("2006-01-02 15:04:05"),
+		Host:    "thor",
+		Message: message,
+	}
+}
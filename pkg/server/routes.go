@@ -42,6 +42,8 @@ func (server *Server) setupRoutes() {
 	// Session is only available on the router so we post there.
 	server.router.GET("/signin", server.Signin)
 	server.router.POST("/signin", server.Signin)
+	server.router.GET("/oidc/login", server.OidcLogin)
+	server.router.GET(OIDC_CALLBACK_PATH, server.OidcCallback)
 
 	server.router.POST("/search", server.Search)
 	server.router.POST("/rotate", server.Rotate)
@@ -68,6 +70,10 @@ func (server *Server) setupRoutes() {
 	server.engine.POST("/api/v1/edge/token", server.EdgeToken)*/
 
 	server.router.GET("/api/v1/log", server.log)
+	server.router.POST("/api/v1/browse", server.Browse)
+	server.router.POST("/api/v1/search", server.AuditSearch)
+	server.router.POST("/api/v1/cleanup", server.Cleanup)
+	server.router.POST("/api/v1/rotatekey", server.RotateKey)
 
 	// test hook - only available if running in debug
 	if os.Getenv("THOR_LOG") == "debug" {
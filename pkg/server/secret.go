@@ -0,0 +1,62 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Apply `update` to the server config and persist it
+//
+// Both happen under the config lock so the config is never
+// saved part way through being changed. `update` may be nil.
+func (server *Server) saveConfig(update func()) error {
+	server.config.Lock()
+	defer server.config.Unlock()
+	if update != nil {
+		update()
+	}
+	return server.config.Save()
+}
+
+// Periodically rotate the AppRole secret-id the server logs in with
+func (server *Server) SecretRotator() {
+	if server.config.Vault.AppRole == nil || server.config.Vault.AppRole.RotationInterval == "" {
+		return
+	}
+
+	interval, err := time.ParseDuration(server.config.Vault.AppRole.RotationInterval)
+	if err != nil {
+		log.Errorf("Secret rotation disabled: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := server.vault.RotateAppRoleSecret(server.saveConfig); err != nil {
+				log.Errorf("Secret rotation: %v", err)
+			}
+		case <-server.stop:
+			return
+		}
+	}
+}
@@ -33,8 +33,11 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/notapipeline/thor/pkg/audit"
 	"github.com/notapipeline/thor/pkg/config"
+	"github.com/notapipeline/thor/pkg/ldap"
 	loki "github.com/notapipeline/thor/pkg/loki"
+	"github.com/notapipeline/thor/pkg/oidc"
 	"github.com/notapipeline/thor/pkg/vault"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -46,7 +49,10 @@ type Server struct {
 	securetoken cookie.Store
 	bolt        *bolt.DB
 	vault       *vault.Vault
-	wakeup      chan string
+	audit       audit.Source
+	ldap        *ldap.Client
+	oidc        *oidc.Provider
+	wakeup      chan *Job
 	stop        chan bool
 	logChannel  chan loki.SimpleMessage
 	logOpen     bool
@@ -65,7 +71,7 @@ func NewServer() *Server {
 		log.Error(fmt.Sprintf("Error opening bolt db: %s", err))
 		return nil
 	}
-	server.wakeup = make(chan string)
+	server.wakeup = make(chan *Job)
 	server.createBuckets()
 	return &server
 }
@@ -88,7 +94,34 @@ func (server *Server) Init() bool {
 		return false
 	}
 
+	if server.config.Vault == nil {
+		log.Error("No vault configuration found")
+		return false
+	}
+
+	if err = server.config.Vault.Validate(); err != nil {
+		log.Errorf("Invalid vault configuration: %v", err)
+		return false
+	}
+
 	server.vault = vault.NewVault(server.config.Vault)
+	if err = server.vault.InitialiseAppRole(server.saveConfig); err != nil {
+		log.Errorf("Failed to initialise approle: %v", err)
+	}
+
+	if err = server.vault.Init(); err != nil {
+		log.Errorf("Failed to initialise vault encryption: %v", err)
+	}
+
+	if server.audit, err = server.auditSources(); err != nil {
+		log.Error("Failed to configure audit sources ", err)
+		return false
+	}
+
+	if server.config.Ldap.Enabled() {
+		server.ldap = ldap.NewClient(server.config.Ldap, server.vault)
+	}
+	server.configureOidc()
 
 	gob.Register(time.Time{})
 	gob.Register(config.User{})
@@ -109,6 +142,8 @@ func (server *Server) Init() bool {
 	server.router.Use(sessions.Sessions(config.SessionCookieName, server.securetoken))
 
 	go server.Wakeup()
+	go server.Reaper()
+	go server.SecretRotator()
 	log.Info("Thor server initialised")
 	return true
 }
@@ -116,12 +151,15 @@ func (server *Server) Init() bool {
 func (server *Server) Wakeup() {
 	for {
 		select {
-		case namespace := <-server.wakeup:
+		case job := <-server.wakeup:
 			if err := server.bolt.View(func(tx *bolt.Tx) error {
-				n := tx.Bucket([]byte(namespace))
+				n := tx.Bucket([]byte(job.Namespace))
+				if n == nil {
+					return fmt.Errorf("No devices registered in namespace %s", job.Namespace)
+				}
 				c := n.Cursor()
 				for k, _ := c.First(); k != nil; k, _ = c.Next() {
-					go server.writeto(string(k), "wakeup")
+					go server.writeto(string(k), fmt.Sprintf("wakeup|%s", job.ID))
 				}
 				return nil
 			}); err != nil {
@@ -19,6 +19,7 @@ package server
 import (
 	b64 "encoding/base64"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/sessions"
@@ -39,6 +40,11 @@ func (server *Server) Signin(c *gin.Context) {
 		return
 	}
 	if c.Request.Method == "POST" && len(request) != 0 {
+		if request["method"] == "ldap" {
+			server.ldapSignin(c, request["username"], request["password"])
+			return
+		}
+
 		log.Debug("Validating signin request")
 		if request["email"] != server.config.Admin.Email {
 			c.Redirect(http.StatusFound, "/signin?error=invalidemail")
@@ -75,6 +81,48 @@ func (server *Server) Signin(c *gin.Context) {
 	c.HTML(http.StatusOK, "signin", web)
 }
 
+// Sign in with a directory account
+//
+// The role is taken from the groups the account is a member of.
+// Accounts granted no role are refused.
+func (server *Server) ldapSignin(c *gin.Context, username, password string) {
+	if server.ldap == nil || !server.config.Ldap.LoginEnabled() {
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	account, err := server.ldap.Authenticate(strings.TrimSpace(username), password)
+	if err != nil {
+		log.Warnf("LDAP signin failed: %v", err)
+		c.Redirect(http.StatusFound, "/signin?error=invalid")
+		return
+	}
+
+	role := server.config.Ldap.Roles.Role(account.Groups)
+	if role == "" {
+		log.Warnf("LDAP signin refused for %s: no role granted", account.DN)
+		c.Redirect(http.StatusFound, "/signin?error=norole")
+		return
+	}
+
+	user := config.User{
+		Admin:  role == config.ROLE_ADMIN,
+		Email:  account.Email,
+		Groups: account.Groups,
+		Role:   role,
+	}
+
+	if user.Email == "" {
+		user.Email = account.Username
+	}
+
+	log.Infof("LDAP signin for %s as %s", user.Email, role)
+	if err := server.signinSession(&user, c); err != nil {
+		log.Error(err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
 func (server *Server) Signout(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Set("NotAfter", time.Now())
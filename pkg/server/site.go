@@ -22,6 +22,7 @@ import (
 	"image/png"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -30,6 +31,7 @@ import (
 	"github.com/crewjam/saml/samlsp"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/notapipeline/thor/pkg/audit"
 	"github.com/notapipeline/thor/pkg/config"
 	"github.com/notapipeline/thor/pkg/loki"
 	"github.com/notapipeline/thor/pkg/vault"
@@ -64,6 +66,7 @@ func (server *Server) Rotate(c *gin.Context) {
 		request["password"] = c.PostForm("password")
 		request["namespace"] = c.PostForm("namespace")
 		request[request["namespace"].(string)] = c.PostFormArray(c.PostForm("namespace") + "[]")
+		request["keys"] = c.PostFormArray("keys[]")
 	}
 
 	if c.Request.Method != "POST" || len(request) == 0 {
@@ -82,19 +85,107 @@ func (server *Server) Rotate(c *gin.Context) {
 
 	if token, ok := request["token"].(string); ok {
 		namespace := request["namespace"].(string)
-		password := request["password"].(string)
-		paths := request[namespace].([]string)
+		password, _ := request["password"].(string)
+		paths, _ := request[namespace].([]string)
+
+		// Keys selected from the tree browser arrive as `path|key`.
+		// Selecting a key implicitly selects the path it lives at.
+		keys := make(map[string][]string)
+		if selected, ok := request["keys"].([]string); ok {
+			for _, k := range selected {
+				parts := strings.SplitN(k, "|", 2)
+				if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					continue
+				}
+				if _, ok := keys[parts[0]]; !ok && !slices.Contains(paths, parts[0]) {
+					paths = append(paths, parts[0])
+				}
+				keys[parts[0]] = append(keys[parts[0]], parts[1])
+			}
+		}
+
+		if len(paths) == 0 {
+			server.Error(c, http.StatusBadRequest, fmt.Errorf("No paths selected for rotation"))
+			return
+		}
+
+		var requester string
+		if user, ok := sessions.Default(c).Get("User").(config.User); ok {
+			requester = user.Email
+		}
+
+		var (
+			override string
+			email    string = strings.TrimSpace(c.PostForm("email"))
+			err      error
+		)
+		if request["type"].(string) == "ex-employee" {
+			if email == "" {
+				server.Error(c, http.StatusBadRequest, fmt.Errorf("An email address is required to rotate for an ex-employee"))
+				return
+			}
+
+			if override, err = server.confirmLeaver(email, c.PostForm("override")); err != nil {
+				server.Error(c, http.StatusForbidden, err)
+				return
+			}
+		}
+
+		job, err := NewJob(namespace, request["type"].(string), requester, paths)
+		if err != nil {
+			server.Error(c, http.StatusInternalServerError, err)
+			return
+		}
+		job.Override = override
+
+		if err := server.saveJob(job); err != nil {
+			server.Error(c, http.StatusInternalServerError, err)
+			return
+		}
 
 		server.logChannel <- loki.SimpleMessage{
 			Time:    time.Now().Format("2006-01-02 15:04:05"),
 			Host:    "thor",
-			Message: "Creating child token",
+			Message: fmt.Sprintf("Creating child token for job %s", job.ID),
 		}
-		if err := server.vault.CreateAndStoreChildCreationToken(token, namespace, paths); err != nil {
+		devices, err := server.devicePaths(namespace)
+		if err != nil {
+			server.Error(c, http.StatusBadRequest, err)
+			return
+		}
+
+		policies, err := server.vault.CreateAndStoreChildCreationToken(token, namespace, job.ID, paths, devices)
+		if err != nil {
+			if e := server.vault.DeletePolicies(namespace, policies); e != nil {
+				log.Errorf("Failed to clean up policies for job %s: %v", job.ID, e)
+			}
 			server.Error(c, http.StatusInternalServerError, err)
 			return
 		}
 
+		// Device tokens are children of the job token and die with it so the
+		// policies are no longer required once the job token has expired.
+		if ttl, err := time.ParseDuration(vault.MAX_TTL); err == nil {
+			time.AfterFunc(ttl, func() {
+				if err := server.vault.DeletePolicies(namespace, policies); err != nil {
+					log.Errorf("Failed to clean up policies for job %s: %v", job.ID, err)
+				}
+			})
+		}
+
+		if request["type"].(string) == "ex-employee" {
+			options := RevokeOptions{
+				DisableEntity: c.PostForm("disableEntity") != "",
+				RevokeTokens:  c.PostForm("revokeTokens") != "",
+			}
+
+			if options.Any() {
+				for _, e := range server.revoke(job, email, options) {
+					web.Error(e)
+				}
+			}
+		}
+
 		current := sessions.Default(c)
 		hosts := make([]string, 0)
 		for _, p := range paths {
@@ -110,19 +201,31 @@ func (server *Server) Rotate(c *gin.Context) {
 			}
 
 			server.vault.ClearRotation(token, namespace, p)
-			if request["type"].(string) == "ex-employee" {
+			switch request["type"].(string) {
+			case "ex-employee":
 				for _, credential := range server.config.Vault.Replaceable {
-					for _, e := range server.vault.Rotate(p, token, credential, namespace, false, &server.logChannel) {
+					for _, e := range server.vault.Rotate(p, token, credential, namespace, false, job.Rotation(), &server.logChannel) {
+						web.Error(e)
+					}
+				}
+			case "manual":
+				// Paths selected without any keys fall back to the replaceable list
+				credentials := keys[p]
+				if len(credentials) == 0 {
+					credentials = server.config.Vault.Replaceable
+				}
+				for _, credential := range credentials {
+					for _, e := range server.vault.Rotate(p, token, credential, namespace, false, job.Rotation(), &server.logChannel) {
 						web.Error(e)
 					}
 				}
-			} else {
-				for _, e := range server.vault.Rotate(p, token, password, namespace, true, &server.logChannel) {
+			default:
+				for _, e := range server.vault.Rotate(p, token, password, namespace, true, job.Rotation(), &server.logChannel) {
 					web.Error(e)
 				}
 			}
 		}
-		server.wakeup <- request["namespace"].(string)
+		server.wakeup <- job
 	}
 	c.HTML(http.StatusOK, "index", web)
 }
@@ -142,25 +245,38 @@ func (server *Server) Search(c *gin.Context) {
 
 	search := Search{}
 	var (
-		err error
-		l   *loki.Loki
+		err    error
+		status int = http.StatusOK
 	)
-	if l, err = loki.NewLoki(server.config.Loki); err != nil {
-		server.Error(c, http.StatusInternalServerError, err)
-		return
-	}
 
-	var status int = http.StatusOK
 	// email search takes precedence...
 	if e, ok := request["email"]; ok && e != "" {
 		log.Infof("Creating ex-employee search for %s", request["email"])
 		search.SearchType = "ex-employee"
 		search.Email = request["email"]
-		results := make([]loki.Result, 0)
-		if err := l.Search(request["email"], &results); err != nil {
+		search.Start = request["start"]
+		search.End = request["end"]
+		results := make([]audit.Result, 0)
+
+		var (
+			window  audit.Window
+			summary audit.Summary
+		)
+		if search.Directory, err = server.directoryStatus(search.Email); err != nil {
+			web.Error(fmt.Errorf("Unable to check directory: %w", err))
+		}
+
+		if window, err = audit.ParseWindow(search.Start, search.End); err == nil {
+			search.Identity, summary, err = server.searchAudit(request["email"], window, &results)
+		}
+
+		if err != nil {
 			status = http.StatusBadRequest
 			web.Error(err)
 		}
+		search.Query = summary.Query
+		search.Truncated = summary.Truncated
+		search.Since = since(summary)
 		log.Infof("Found %d results", len(results))
 		search.Results = &results
 	} else if _, ok := request["password"]; ok {
@@ -231,10 +347,11 @@ func (server *Server) Configure(c *gin.Context) {
 			return
 		}
 
-		server.config.Admin.Email = email
-		server.config.Admin.Password = b64.StdEncoding.EncodeToString(hashedPassword)
-		server.config.Configured = true
-		if err := server.config.Save(); err != nil {
+		if err := server.saveConfig(func() {
+			server.config.Admin.Email = email
+			server.config.Admin.Password = b64.StdEncoding.EncodeToString(hashedPassword)
+			server.config.Configured = true
+		}); err != nil {
 			c.Redirect(http.StatusFound, "/configure?error=save")
 			return
 		}
@@ -265,9 +382,10 @@ func (server *Server) Settings(c *gin.Context) {
 		email := strings.ToLower(strings.TrimSpace(request["email"]))
 		samlMetadata := strings.TrimSpace(request["saml_metadata"])
 
-		server.config.Admin.Email = email
-		server.config.Saml.IDPMetadata = samlMetadata
-		if err := server.config.Save(); err != nil {
+		if err := server.saveConfig(func() {
+			server.config.Admin.Email = email
+			server.config.Saml.IDPMetadata = samlMetadata
+		}); err != nil {
 			c.Redirect(http.StatusFound, "/settings?error=save")
 			return
 		}
@@ -282,6 +400,12 @@ func (server *Server) Settings(c *gin.Context) {
 			server.config.Saml.SamlSP = nil
 		}
 
+		if err := server.oidcSettings(request); err != nil {
+			log.Warnf("Failed to configure OIDC %s", err)
+			c.Redirect(http.StatusFound, "/settings?error=oidc")
+			return
+		}
+
 		currentPassword := request["current_password"]
 		newPassword := request["new_password"]
 		configPassword, _ := b64.StdEncoding.DecodeString(server.config.Admin.Password)
@@ -303,8 +427,9 @@ func (server *Server) Settings(c *gin.Context) {
 				return
 			}
 
-			server.config.Admin.Password = b64.StdEncoding.EncodeToString(hashedPassword)
-			if err := server.config.Save(); err != nil {
+			if err := server.saveConfig(func() {
+				server.config.Admin.Password = b64.StdEncoding.EncodeToString(hashedPassword)
+			}); err != nil {
 				c.Redirect(http.StatusFound, "/settings?error=save")
 				return
 			}
@@ -318,7 +443,7 @@ func (server *Server) Settings(c *gin.Context) {
 				c.Redirect(http.StatusFound, "/settings?error=totp")
 				return
 			}
-			if err := server.config.Save(); err != nil {
+			if err := server.saveConfig(nil); err != nil {
 				c.Redirect(http.StatusFound, "/settings?error=save")
 				return
 			}
@@ -332,8 +457,9 @@ func (server *Server) Settings(c *gin.Context) {
 				c.Redirect(http.StatusFound, "/settings?error=totp")
 				return
 			}
-			server.config.Admin.TotpKey = server.config.AdminOTP.Secret()
-			if err := server.config.Save(); err != nil {
+			if err := server.saveConfig(func() {
+				server.config.Admin.TotpKey = server.config.AdminOTP.Secret()
+			}); err != nil {
 				c.Redirect(http.StatusFound, "/settings?error=save")
 				return
 			}
@@ -347,6 +473,60 @@ func (server *Server) Settings(c *gin.Context) {
 	c.HTML(http.StatusOK, "settings", web)
 }
 
+// Update the OpenID Connect provider from the settings form
+//
+// Groups granted each role are given comma separated. Clearing the
+// issuer disables OIDC sign in.
+func (server *Server) oidcSettings(request map[string]string) error {
+	issuer := strings.TrimSpace(request["oidc_issuer"])
+	if issuer == "" {
+		if server.config.Oidc != nil {
+			err := server.saveConfig(func() {
+				server.config.Oidc = nil
+			})
+			server.configureOidc()
+			return err
+		}
+		return nil
+	}
+
+	oidc := config.OidcConfig{}
+	if server.config.Oidc != nil {
+		oidc = *server.config.Oidc
+	}
+
+	oidc.Issuer = issuer
+	oidc.ClientID = strings.TrimSpace(request["oidc_client_id"])
+	oidc.ClientSecretPath = strings.TrimSpace(request["oidc_client_secret_path"])
+	oidc.GroupsClaim = strings.TrimSpace(request["oidc_groups_claim"])
+	oidc.Roles = config.RoleMapping{}
+	for _, role := range []string{config.ROLE_ADMIN, config.ROLE_OPERATOR} {
+		groups := make([]string, 0)
+		for _, group := range strings.Split(request["oidc_"+role+"_groups"], ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+		if len(groups) > 0 {
+			oidc.Roles[role] = groups
+		}
+	}
+
+	if !oidc.Enabled() {
+		return fmt.Errorf("oidc requires both an issuer and a client id")
+	}
+
+	if err := oidc.Configure(); err != nil {
+		return err
+	}
+
+	err := server.saveConfig(func() {
+		server.config.Oidc = &oidc
+	})
+	server.configureOidc()
+	return err
+}
+
 // Get a QR Code for admin access
 func (server *Server) AdminQR(c *gin.Context) {
 	web := NewWeb(c, server.config)
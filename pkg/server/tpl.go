@@ -72,6 +72,7 @@ func (tplEngine TplEngine) FuncMap() template.FuncMap {
 	return template.FuncMap{
 		"hasprefix": strings.HasPrefix,
 		"hassuffix": strings.HasSuffix,
+		"join":      strings.Join,
 		"add": func(a, b int) int {
 			return a + b
 		},
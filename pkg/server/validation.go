@@ -44,7 +44,7 @@ func (server *Server) RequireAccount(c *gin.Context) {
 	}
 
 	section := strings.Trim(strings.Split(c.Request.RequestURI, "?")[0], "/")
-	if section == "signin" || section == "signout" {
+	if section == "signin" || section == "signout" || section == "oidc/login" || section == "oidc/callback" {
 		return
 	}
 
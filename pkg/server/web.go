@@ -25,6 +25,7 @@ import (
 	"github.com/crewjam/saml/samlsp"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/notapipeline/thor/pkg/audit"
 	"github.com/notapipeline/thor/pkg/config"
 	"github.com/pquerna/otp"
 	log "github.com/sirupsen/logrus"
@@ -37,6 +38,26 @@ type Search struct {
 	Namespace  string
 	VaultToken string
 
+	// Dates bounding an ex-employee search
+	Start string
+	End   string
+
+	// State of the ex-employee's account in the directory
+	Directory string
+
+	// Everything the ex-employee was searched for as
+	Identity *audit.Identity
+
+	// The audit log query executed for the search
+	Query string
+
+	// Set when a limit stopped the whole window being searched
+	Truncated bool
+
+	// Earliest date searched when no start was given and a
+	// source could not search all of its history
+	Since string
+
 	Results interface{}
 }
 
@@ -55,7 +76,10 @@ type Web struct {
 	Time      time.Time
 	Admin     bool
 	SamlM     *samlsp.Middleware
+	LdapLogin bool
+	OidcLogin bool
 	Saml      config.SamlConfig
+	Oidc      config.OidcConfig
 	Info      config.Admin
 	User      config.User
 	Errors    []string
@@ -80,6 +104,8 @@ func NewWeb(c *gin.Context, conf *config.Config) *Web {
 		Section:     section,
 		Time:        time.Now(),
 		SamlM:       conf.Saml.SamlSP,
+		LdapLogin:   conf.Ldap.LoginEnabled(),
+		OidcLogin:   conf.Oidc.Enabled(),
 		Saml:        *conf.Saml,
 		TempTotpKey: conf.AdminOTP,
 		Search:      &Search{},
@@ -88,6 +114,10 @@ func NewWeb(c *gin.Context, conf *config.Config) *Web {
 		WebSocket:   fmt.Sprintf("%s:%d", conf.TLS.HostName, conf.TLS.Port),
 	}
 
+	if conf.Oidc != nil {
+		web.Oidc = *conf.Oidc
+	}
+
 	if _, ok := c.Get(sessions.DefaultKey); ok {
 		session := sessions.Default(c)
 		if session.Get("Admin") != nil {
@@ -54,7 +54,7 @@ func (server *Server) log(c *gin.Context) {
 		}
 	)
 
-	if l, err = loki.NewLoki(server.config.Loki); err != nil {
+	if l, err = loki.NewLoki(server.config.Loki, server.vault); err != nil {
 		server.Error(c, http.StatusInternalServerError, err)
 		return
 	}
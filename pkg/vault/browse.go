@@ -0,0 +1,139 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/notapipeline/thor/pkg/kv"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NODE_MOUNT  = "mount"
+	NODE_FOLDER = "folder"
+	NODE_SECRET = "secret"
+	NODE_KEY    = "key"
+)
+
+// A single entry in the vault tree browser
+type Node struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+}
+
+// Browse a single level of the KV tree in a given namespace
+//
+// An empty path returns the list of KV mounts available in the namespace,
+// a path ending in `/` lists the folders and secrets beneath it and any
+// other path is treated as a secret, returning the names of the keys stored
+// there. Values are never returned.
+func (v *Vault) Browse(token, namespace, path string) ([]Node, error) {
+	client, err := v.tokenClient(token, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0)
+	switch {
+	case path == "":
+		resolver, err := v.resolver(client)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range resolver.Mounts() {
+			folder := kv.Secret{Mount: m}
+			nodes = append(nodes, Node{
+				Name: strings.TrimSuffix(m.Path, "/"),
+				Path: folder.ListPath(),
+				Type: NODE_MOUNT,
+			})
+		}
+	case strings.HasSuffix(path, "/"):
+		log.Debugf("Browsing %s in namespace %s", path, namespace)
+		folder, err := v.resolve(client, path)
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := client.Logical().List(folder.ListPath())
+		if err != nil {
+			return nil, err
+		}
+
+		if contents == nil {
+			break
+		}
+
+		keys, ok := contents.Data["keys"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unable to list contents of %s", path)
+		}
+
+		for _, k := range keys {
+			name := k.(string)
+			child := folder.Child(name)
+			if strings.HasSuffix(name, "/") {
+				nodes = append(nodes, Node{
+					Name: strings.TrimSuffix(name, "/"),
+					Path: child.ListPath(),
+					Type: NODE_FOLDER,
+				})
+				continue
+			}
+			nodes = append(nodes, Node{
+				Name: name,
+				Path: child.DataPath(),
+				Type: NODE_SECRET,
+			})
+		}
+	default:
+		key, err := v.resolve(client, path)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := client.Logical().Read(key.DataPath())
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil {
+			return nil, fmt.Errorf("No secret found at %s", path)
+		}
+
+		for name := range secretData(secret, key.V2()) {
+			// Rotation state written by earlier versions of Thor
+			if name == LEGACY_ROTATED_KEY {
+				continue
+			}
+			nodes = append(nodes, Node{
+				Name: name,
+				Path: key.DataPath(),
+				Type: NODE_KEY,
+			})
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes, nil
+}
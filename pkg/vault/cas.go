@@ -0,0 +1,144 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/notapipeline/thor/pkg/kv"
+)
+
+const (
+	// Number of times a KV version 2 write is retried after
+	// another writer has changed the secret
+	CAS_RETRIES = 3
+)
+
+// Returned when a KV version 2 secret keeps changing underneath an update
+type ConflictError struct {
+	Path    string
+	Version int64
+	Keys    []string
+}
+
+func (e *ConflictError) Error() string {
+	var msg string = fmt.Sprintf("Conflict updating %s: secret was modified by another writer (version %d)", e.Path, e.Version)
+	if len(e.Keys) > 0 {
+		msg = fmt.Sprintf("%s, keys not updated: %s", msg, strings.Join(e.Keys, ", "))
+	}
+	return msg
+}
+
+// Read-modify-write a secret
+//
+// `apply` receives the current secret data and reports whether it has
+// been changed. For KV version 2, the write is sent with the version read
+// as check-and-set. If another writer got there first, the secret is read
+// again and `apply` re-run against the latest data so only the keys it
+// targets are changed.
+//
+// Returns the data written or nil if nothing changed.
+func (v *Vault) update(client *vault.Client, key *kv.Secret, apply func(data map[string]interface{}) bool) (map[string]interface{}, error) {
+	var (
+		version int64
+		path    string = key.DataPath()
+		v2      bool   = key.V2()
+	)
+	for attempt := 0; attempt <= CAS_RETRIES; attempt++ {
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil {
+			return nil, nil
+		}
+
+		data := secretData(secret, v2)
+		if !apply(data) {
+			return nil, nil
+		}
+
+		d := data
+		if v2 {
+			version = secretVersion(secret)
+			d = map[string]interface{}{
+				"data": data,
+				"options": map[string]interface{}{
+					"cas": version,
+				},
+			}
+		}
+
+		if _, err = client.Logical().Write(path, d); err == nil {
+			return data, nil
+		} else if !v2 || !isCASConflict(err) {
+			return nil, err
+		}
+	}
+	return nil, &ConflictError{
+		Path:    path,
+		Version: version,
+	}
+}
+
+// Get the data held in a secret
+func secretData(secret *vault.Secret, v2 bool) map[string]interface{} {
+	if !v2 {
+		return secret.Data
+	}
+
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		return data
+	}
+	return make(map[string]interface{})
+}
+
+// Get the version of a KV version 2 secret
+func secretVersion(secret *vault.Secret) int64 {
+	metadata, ok := secret.Data["metadata"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+
+	if version, ok := metadata["version"].(json.Number); ok {
+		if v, err := version.Int64(); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// Check if an error is a KV version 2 check-and-set mismatch
+func isCASConflict(err error) bool {
+	var response *vault.ResponseError
+	if !errors.As(err, &response) || response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, e := range response.Errors {
+		if strings.Contains(e, "check-and-set") {
+			return true
+		}
+	}
+	return false
+}
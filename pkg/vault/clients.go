@@ -17,14 +17,116 @@
 package vault
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/api/auth/aws"
 	"github.com/hashicorp/vault/api/auth/azure"
+	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// Margin left before the role token expires to log in again
+	EXPIRY_GRACE = 30 * time.Second
+)
+
+// Retries requests refused to the role token once with a new login
+//
+// Vault refuses a revoked token with permission denied. Other requests
+// are refused the same way when the token lacks the capability so the
+// token is looked up before logging in again and the original response
+// returned if it is still valid.
+type reloginTransport struct {
+	vault *Vault
+	base  http.RoundTripper
+}
+
+// Retry requests made with the role token on `c` after a new login if refused
+func (v *Vault) relogin(c *vault.Config) {
+	if c == nil || c.HttpClient == nil {
+		return
+	}
+
+	var base http.RoundTripper = c.HttpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	client := *c.HttpClient
+	client.Transport = &reloginTransport{vault: v, base: base}
+	c.HttpClient = &client
+}
+
+func (t *reloginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := req.Header.Get(vault.AuthHeaderName)
+	if token == "" || token != t.vault.roleToken() {
+		return t.base.RoundTrip(req)
+	}
+
+	// The body is kept so the request can be sent again
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	response, err := t.base.RoundTrip(req)
+	if err != nil || response.StatusCode != http.StatusForbidden || t.valid(req, token) {
+		return response, err
+	}
+
+	log.Warn("Vault role token has been revoked, logging in again")
+	t.vault.resetRoleClient(token)
+	client, err := t.vault.roleClient()
+	if err != nil {
+		log.Errorf("Unable to log in to vault: %v", err)
+		return response, nil
+	}
+	response.Body.Close()
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set(vault.AuthHeaderName, client.Token())
+	if body != nil {
+		retry.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// Check if `token` is still accepted by vault
+func (t *reloginTransport) valid(req *http.Request, token string) bool {
+	u := *req.URL
+	u.Path, u.RawPath, u.RawQuery = "/v1/auth/token/lookup-self", "", ""
+
+	lookup, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return true
+	}
+	lookup.Header.Set(vault.AuthHeaderName, token)
+	if ns := req.Header.Get(vault.NamespaceHeaderName); ns != "" {
+		lookup.Header.Set(vault.NamespaceHeaderName, ns)
+	}
+
+	response, err := t.base.RoundTrip(lookup)
+	if err != nil {
+		return true
+	}
+	response.Body.Close()
+	return response.StatusCode != http.StatusForbidden
+}
+
 func (v *Vault) tokenClient(token, namespace string) (*vault.Client, error) {
 	client, err := vault.NewClient(v.config.VaultConfig)
 	if err != nil {
@@ -40,54 +142,297 @@ func (v *Vault) tokenClient(token, namespace string) (*vault.Client, error) {
 }
 
 // Helper function to get the configured client
+//
+// The role login is shared between callers and kept alive by a lifetime
+// watcher. Each caller receives its own copy of the client so changes
+// to namespace or wrapping do not leak between requests.
 func (v *Vault) roleClient() (*vault.Client, error) {
+	v.clientMu.Lock()
+	defer v.clientMu.Unlock()
+
+	if v.client == nil || (!v.expires.IsZero() && time.Now().After(v.expires)) {
+		client, secret, err := v.login()
+		if err != nil {
+			return nil, err
+		}
+		v.setRoleClient(client, secret)
+	}
+
+	client, err := v.client.CloneWithHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone Vault client: %w", err)
+	}
+	client.SetToken(v.client.Token())
+	return client, nil
+}
+
+// Discard the cached role client forcing the next caller to log in again
+func (v *Vault) ResetRoleClient() {
+	v.resetRoleClient("")
+}
+
+// Discard the cached role client if it still holds `token`
+//
+// An empty token discards the client whatever it holds.
+func (v *Vault) resetRoleClient(token string) {
+	v.clientMu.Lock()
+	defer v.clientMu.Unlock()
+	if token == "" || (v.client != nil && v.client.Token() == token) {
+		v.setRoleClient(nil, nil)
+	}
+}
+
+// Get the token held by the cached role client
+//
+// Guarded separately from the client as it is read while
+// requests are made during login.
+func (v *Vault) roleToken() string {
+	v.tokenMu.RLock()
+	defer v.tokenMu.RUnlock()
+	return v.token
+}
+
+// Replace the cached role client, stopping any watcher on the previous one
+//
+// Must be called with clientMu held.
+func (v *Vault) setRoleClient(client *vault.Client, secret *vault.Secret) {
+	if v.watcher != nil {
+		v.watcher.Stop()
+		v.watcher = nil
+	}
+
+	v.tokenMu.Lock()
+	v.client, v.token = client, ""
+	if client != nil {
+		v.token = client.Token()
+	}
+	v.tokenMu.Unlock()
+
+	v.expires = time.Time{}
+	if client == nil || secret == nil || secret.Auth == nil {
+		return
+	}
+
+	if secret.Auth.LeaseDuration > 0 {
+		v.expires = expiry(time.Now(), secret.Auth.LeaseDuration)
+	}
+
+	if !secret.Auth.Renewable {
+		return
+	}
+
+	watcher, err := client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{
+		Secret: secret,
+	})
+	if err != nil {
+		log.Warnf("Unable to watch Vault token lifetime: %v", err)
+		return
+	}
+	v.watcher = watcher
+	go watcher.Start()
+	go v.watch(client, watcher)
+}
+
+// Get when a token leased for `lease` seconds from `from` should be replaced
+//
+// A margin is left before the lease ends so requests in flight
+// are not made with a token which expires before they arrive.
+func expiry(from time.Time, lease int) time.Time {
 	var (
-		multiple bool = false
-		none     bool = true
+		duration time.Duration = time.Duration(lease) * time.Second
+		grace    time.Duration = min(EXPIRY_GRACE, duration/10)
 	)
-	for _, c := range []bool{
-		v.config.AppRole == nil,
-		v.config.AzureRole == nil,
-		v.config.AwsRole == nil,
-	} {
-		if c {
-			none = false
-			continue
-		}
+	return from.Add(duration - grace)
+}
+
+// Track renewals of the role token
+//
+// Once the token can no longer be renewed, either because it has reached
+// its maximum TTL or it has been revoked, the client is discarded.
+func (v *Vault) watch(client *vault.Client, watcher *vault.LifetimeWatcher) {
+	for {
+		select {
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Warnf("Vault role token renewal stopped: %v", err)
+			}
 
-		if !none && c {
-			multiple = true
-			break
+			v.clientMu.Lock()
+			if v.client == client {
+				v.tokenMu.Lock()
+				v.client, v.token = nil, ""
+				v.tokenMu.Unlock()
+				v.watcher = nil
+				v.expires = time.Time{}
+			}
+			v.clientMu.Unlock()
+			return
+		case renewal := <-watcher.RenewCh():
+			if renewal == nil || renewal.Secret == nil || renewal.Secret.Auth == nil {
+				continue
+			}
+
+			log.Debugf("Renewed Vault role token at %s", renewal.RenewedAt)
+			v.clientMu.Lock()
+			if v.client == client {
+				v.expires = expiry(renewal.RenewedAt, renewal.Secret.Auth.LeaseDuration)
+			}
+			v.clientMu.Unlock()
 		}
 	}
+}
 
-	var msg string = "One of `AwsRole`, `AzureRole`, `AppRole` must be configured. Please update your configuration file."
-	if none {
-		return nil, fmt.Errorf(msg)
-	} else if multiple {
-		msg = fmt.Sprintf("Only %s.", msg)
-		return nil, fmt.Errorf(msg)
+// Log in with the configured auth method
+func (v *Vault) login() (*vault.Client, *vault.Secret, error) {
+	if err := v.config.Validate(); err != nil {
+		return nil, nil, err
 	}
 
-	if v.config.AppRole != nil {
+	switch {
+	case v.config.AppRole != nil:
 		return v.appRoleClient()
+	case v.config.AzureRole != nil:
+		return v.azureRoleClient()
+	case v.config.AwsRole != nil:
+		return v.awsRoleClient()
+	case v.config.KubernetesRole != nil:
+		return v.kubernetesRoleClient()
+	case v.config.JwtRole != nil:
+		return v.jwtRoleClient()
+	case v.config.CertRole != nil:
+		return v.certRoleClient()
+	case v.config.Userpass != nil:
+		return v.userpassClient()
 	}
 
-	if v.config.AzureRole != nil {
-		return v.azureRoleClient()
+	return nil, nil, fmt.Errorf("No vault role configured")
+}
+
+// Create an unauthenticated client in the servers namespace
+func (v *Vault) loginClient(c *vault.Config) (*vault.Client, error) {
+	client, err := vault.NewClient(c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
 	}
 
-	if v.config.AwsRole != nil {
-		return v.awsRoleClient()
+	if v.config.Namespace != "" && v.config.Namespace != "root" {
+		client.SetNamespace(v.config.Namespace)
+	}
+	return client, nil
+}
+
+// Write a login request and set the returned token on the client
+func (v *Vault) writeLogin(client *vault.Client, path, method string, params map[string]interface{}) (*vault.Secret, error) {
+	resp, err := client.Logical().Write(path, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to log in with %s: %w", method, err)
+	}
+	if resp == nil || resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("login response did not return client token")
+	}
+
+	client.SetToken(resp.Auth.ClientToken)
+	return resp, nil
+}
+
+func (v *Vault) kubernetesRoleClient() (*vault.Client, *vault.Secret, error) {
+	client, err := v.loginClient(v.config.VaultConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jwt, err := os.ReadFile(v.config.KubernetesRole.TokenPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read service account token: %w", err)
+	}
+
+	secret, err := v.writeLogin(client, path.Join("auth", v.config.KubernetesRole.Mount, "login"), "kubernetes", map[string]interface{}{
+		"role": v.config.KubernetesRole.RoleName,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return client, secret, nil
+}
 
-	return nil, fmt.Errorf("No vault role configured")
+func (v *Vault) jwtRoleClient() (*vault.Client, *vault.Secret, error) {
+	client, err := v.loginClient(v.config.VaultConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A token path is re-read on every login as these
+	// are commonly refreshed by the platform
+	var jwt string = v.config.JwtRole.Token
+	if v.config.JwtRole.TokenPath != "" {
+		b, err := os.ReadFile(v.config.JwtRole.TokenPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read jwt: %w", err)
+		}
+		jwt = strings.TrimSpace(string(b))
+	}
+
+	secret, err := v.writeLogin(client, path.Join("auth", v.config.JwtRole.Mount, "login"), "jwt", map[string]interface{}{
+		"role": v.config.JwtRole.RoleName,
+		"jwt":  jwt,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, secret, nil
 }
 
-func (v *Vault) awsRoleClient() (*vault.Client, error) {
+func (v *Vault) certRoleClient() (*vault.Client, *vault.Secret, error) {
+	// The client certificate is presented during the TLS handshake
+	// so the login requires a client of its own
+	c := vault.DefaultConfig()
+	c.Address = v.config.Address
+	if err := c.ConfigureTLS(&vault.TLSConfig{
+		CACert:     v.config.CertRole.Cacert,
+		ClientCert: v.config.CertRole.Cert,
+		ClientKey:  v.config.CertRole.Key,
+	}); err != nil {
+		return nil, nil, fmt.Errorf("unable to configure client certificate: %w", err)
+	}
+	v.relogin(c)
+
+	client, err := v.loginClient(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var params map[string]interface{} = make(map[string]interface{})
+	if v.config.CertRole.RoleName != "" {
+		params["name"] = v.config.CertRole.RoleName
+	}
+
+	secret, err := v.writeLogin(client, path.Join("auth", v.config.CertRole.Mount, "login"), "cert", params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, secret, nil
+}
+
+func (v *Vault) userpassClient() (*vault.Client, *vault.Secret, error) {
+	client, err := v.loginClient(v.config.VaultConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := v.writeLogin(client, path.Join("auth", v.config.Userpass.Mount, "login", v.config.Userpass.Username), "userpass", map[string]interface{}{
+		"password": v.config.Userpass.Password,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, secret, nil
+}
+
+func (v *Vault) awsRoleClient() (*vault.Client, *vault.Secret, error) {
 	client, err := vault.NewClient(v.config.VaultConfig)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
+		return nil, nil, fmt.Errorf("unable to initialize Vault client: %w", err)
 	}
 
 	if v.config.Namespace != "" && v.config.Namespace != "root" {
@@ -96,23 +441,23 @@ func (v *Vault) awsRoleClient() (*vault.Client, error) {
 
 	awsAuth, err := aws.NewAWSAuth(aws.WithRole(v.config.AwsRole.RoleName))
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize AWS auth method: %w", err)
+		return nil, nil, fmt.Errorf("unable to initialize AWS auth method: %w", err)
 	}
 
 	authInfo, err := client.Auth().Login(context.TODO(), awsAuth)
 	if err != nil {
-		return nil, fmt.Errorf("unable to login to AWS auth method: %w", err)
+		return nil, nil, fmt.Errorf("unable to login to AWS auth method: %w", err)
 	}
 	if authInfo == nil {
-		return nil, fmt.Errorf("no auth info was returned after login")
+		return nil, nil, fmt.Errorf("no auth info was returned after login")
 	}
-	return client, nil
+	return client, authInfo, nil
 }
 
-func (v *Vault) azureRoleClient() (*vault.Client, error) {
+func (v *Vault) azureRoleClient() (*vault.Client, *vault.Secret, error) {
 	client, err := vault.NewClient(v.config.VaultConfig)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
+		return nil, nil, fmt.Errorf("unable to initialize Vault client: %w", err)
 	}
 
 	if v.config.Namespace != "" && v.config.Namespace != "root" {
@@ -121,23 +466,23 @@ func (v *Vault) azureRoleClient() (*vault.Client, error) {
 
 	azureAuth, err := azure.NewAzureAuth(v.config.AzureRole.RoleName)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize Azure auth method: %w", err)
+		return nil, nil, fmt.Errorf("unable to initialize Azure auth method: %w", err)
 	}
 
 	authInfo, err := client.Auth().Login(context.TODO(), azureAuth)
 	if err != nil {
-		return nil, fmt.Errorf("unable to login to Azure auth method: %w", err)
+		return nil, nil, fmt.Errorf("unable to login to Azure auth method: %w", err)
 	}
 	if authInfo == nil {
-		return nil, fmt.Errorf("no auth info was returned after login")
+		return nil, nil, fmt.Errorf("no auth info was returned after login")
 	}
-	return client, nil
+	return client, authInfo, nil
 }
 
-func (v *Vault) appRoleClient() (*vault.Client, error) {
+func (v *Vault) appRoleClient() (*vault.Client, *vault.Secret, error) {
 	client, err := vault.NewClient(v.config.VaultConfig)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
+		return nil, nil, fmt.Errorf("unable to initialize Vault client: %w", err)
 	}
 
 	if v.config.Namespace != "" && v.config.Namespace != "root" {
@@ -149,14 +494,14 @@ func (v *Vault) appRoleClient() (*vault.Client, error) {
 	if v.config.AppRole.ResponseWrapped {
 		unwrappedToken, err := client.Logical().Unwrap(string(secretID))
 		if err != nil {
-			return nil, fmt.Errorf("unable to unwrap token: %w", err)
+			return nil, nil, fmt.Errorf("unable to unwrap token: %w", err)
 		}
 		secretID = unwrappedToken.Data["secret_id"].(string)
 	}
 
 	roleID := v.config.AppRole.RoleId
 	if roleID == "" {
-		return nil, fmt.Errorf("no role ID was provided")
+		return nil, nil, fmt.Errorf("no role ID was provided")
 	}
 
 	params := map[string]interface{}{
@@ -164,14 +509,14 @@ func (v *Vault) appRoleClient() (*vault.Client, error) {
 		"secret_id": secretID,
 	}
 
-	resp, err := client.Logical().Write("auth/approle/login", params)
+	resp, err := client.Logical().Write(path.Join("auth", v.config.AppRole.Mount, "login"), params)
 	if err != nil {
-		return nil, fmt.Errorf("unable to log in with approle: %w", err)
+		return nil, nil, fmt.Errorf("unable to log in with approle: %w", err)
 	}
 	if resp == nil || resp.Auth == nil || resp.Auth.ClientToken == "" {
-		return nil, fmt.Errorf("login response did not return client token")
+		return nil, nil, fmt.Errorf("login response did not return client token")
 	}
 
 	client.SetToken(resp.Auth.ClientToken)
-	return client, nil
+	return client, resp, nil
 }
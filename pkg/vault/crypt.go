@@ -17,46 +17,173 @@
 package vault
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
 	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 )
 
+//
+// Envelope format
+//
+// magic (4) | version (1) | kdf (1) | salt (16) | nonce (12) | ciphertext
+//
+// The header is authenticated along with the purpose of the ciphertext
+// and the device it was created for. Ciphertexts without the magic
+// prefix pre-date the envelope and carry no associated data. They are
+// only decrypted, using the legacy SHA-256 derived key, where the
+// caller is migrating them.
+//
+
+const (
+	ENVELOPE_MAGIC   string = "THOR"
+	ENVELOPE_VERSION byte   = 1
+
+	KDF_HKDF_SHA256 byte = 1
+	KDF_ARGON2ID    byte = 2
+
+	SALT_SIZE int = 16
+
+	PURPOSE_SECURE_TOKEN string = "secure-token"
+	PURPOSE_AGENT_TOKEN  string = "agent-token"
+)
+
+// Binds a ciphertext to what it protects and who it was created for
+type AssociatedData struct {
+	Purpose string
+	Device  string
+}
+
+func (a AssociatedData) bytes(header []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(header)
+	buffer.WriteString(a.Purpose)
+	buffer.WriteByte(0)
+	buffer.WriteString(a.Device)
+	return buffer.Bytes()
+}
+
+// Derive an AES-256 key from a passphrase
+func deriveKey(kdf byte, passphrase string, salt []byte, purpose string) ([]byte, error) {
+	switch kdf {
+	case KDF_HKDF_SHA256:
+		key := make([]byte, 32)
+		reader := hkdf.New(sha256.New, []byte(passphrase), salt, []byte("thor-envelope-"+purpose))
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case KDF_ARGON2ID:
+		return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32), nil
+	}
+	return nil, fmt.Errorf("Unknown key derivation function %d", kdf)
+}
+
 func createHash(key string) []byte {
 	data := sha256.Sum256([]byte(key))
 	return data[:]
 }
 
-func encrypt(data []byte, passphrase string) ([]byte, error) {
-	block, err := aes.NewCipher(createHash(passphrase))
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return cipher.NewGCM(block)
+}
+
+func encrypt(data []byte, passphrase string, ad AssociatedData) ([]byte, error) {
+	salt := make([]byte, SALT_SIZE)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(KDF_HKDF_SHA256, passphrase, salt, ad.Purpose)
 	if err != nil {
 		return nil, err
 	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+
+	var header []byte = []byte(ENVELOPE_MAGIC)
+	header = append(header, ENVELOPE_VERSION, KDF_HKDF_SHA256)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	return gcm.Seal(header, nonce, data, ad.bytes(header)), nil
 }
 
-func decrypt(data []byte, passphrase string) ([]byte, error) {
-	key := []byte(createHash(passphrase))
-	block, err := aes.NewCipher(key)
+// Check if a ciphertext uses the envelope format
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ENVELOPE_MAGIC))
+}
+
+func decrypt(data []byte, passphrase string, ad AssociatedData) ([]byte, error) {
+	if !isEnvelope(data) {
+		return nil, fmt.Errorf("Ciphertext pre-dates the envelope format")
+	}
+
+	var offset int = len(ENVELOPE_MAGIC)
+	if len(data) < offset+2+SALT_SIZE {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+
+	if version := data[offset]; version != ENVELOPE_VERSION {
+		return nil, fmt.Errorf("Unsupported envelope version %d", version)
+	}
+
+	var (
+		kdf  byte   = data[offset+1]
+		salt []byte = data[offset+2 : offset+2+SALT_SIZE]
+	)
+
+	key, err := deriveKey(kdf, passphrase, salt, ad.Purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+
+	offset += 2 + SALT_SIZE
+	if len(data) < offset+gcm.NonceSize() {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+
+	var (
+		header     []byte = data[:offset+gcm.NonceSize()]
+		nonce      []byte = data[offset : offset+gcm.NonceSize()]
+		ciphertext []byte = data[offset+gcm.NonceSize():]
+	)
+	return gcm.Open(nil, nonce, ciphertext, ad.bytes(header))
+}
+
+// Decrypt ciphertexts created prior to the envelope format
+func decryptLegacy(data []byte, passphrase string) ([]byte, error) {
+	gcm, err := newGCM(createHash(passphrase))
 	if err != nil {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
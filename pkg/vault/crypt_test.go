@@ -0,0 +1,83 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	var ad AssociatedData = AssociatedData{Purpose: PURPOSE_AGENT_TOKEN, Device: "10.0.0.1"}
+
+	ciphertext, err := encrypt([]byte("s.token"), "passphrase", ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		ad         AssociatedData
+		ciphertext []byte
+		valid      bool
+	}{
+		{"round trip", "passphrase", ad, ciphertext, true},
+		{"wrong passphrase", "other", ad, ciphertext, false},
+		{"wrong device", "passphrase", AssociatedData{Purpose: PURPOSE_AGENT_TOKEN, Device: "10.0.0.2"}, ciphertext, false},
+		{"wrong purpose", "passphrase", AssociatedData{Purpose: PURPOSE_SECURE_TOKEN, Device: "10.0.0.1"}, ciphertext, false},
+		{"truncated", "passphrase", ad, ciphertext[:len(ENVELOPE_MAGIC)+4], false},
+		{"tampered header", "passphrase", ad, append([]byte(ENVELOPE_MAGIC), append([]byte{ENVELOPE_VERSION, KDF_ARGON2ID}, ciphertext[len(ENVELOPE_MAGIC)+2:]...)...), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := decrypt(tt.ciphertext, tt.passphrase, tt.ad)
+			if tt.valid && (err != nil || !bytes.Equal(plaintext, []byte("s.token"))) {
+				t.Errorf("expected s.token, got %q: %v", plaintext, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected an error, got %q", plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	gcm, err := newGCM(createHash("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := gcm.Seal(nonce, nonce, []byte("s.token"), nil)
+
+	var (
+		v    *Vault         = &Vault{}
+		what string         = base64.StdEncoding.EncodeToString(legacy)
+		ad   AssociatedData = secureTokenData("job")
+	)
+
+	if _, err := v.Decrypt(what, "passphrase", ad); err == nil {
+		t.Error("expected legacy ciphertext to be refused")
+	}
+
+	plaintext, wasLegacy, err := v.decrypt(what, "passphrase", ad, true)
+	if err != nil || plaintext != "s.token" || !wasLegacy {
+		t.Errorf("expected legacy s.token, got %q (%t): %v", plaintext, wasLegacy, err)
+	}
+}
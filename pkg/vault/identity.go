@@ -0,0 +1,302 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/notapipeline/thor/pkg/audit"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolve a person to every identifier Vault holds for them
+//
+// `user` is looked up as an entity name and as an alias name on every
+// auth mount. Each entity found contributes its name, the names of all
+// of its aliases and any entity IDs merged into it.
+//
+// Finding the tokens issued to the entities means looking up every
+// token in Vault so is only done when `tokens` is set. Their accessors
+// are added to the identity, along with their hash from each audit
+// device so they can be found in audit logs where accessors are HMAC'd,
+// and the tokens returned.
+//
+// Lookups Thor is not permitted to make are logged and skipped so the
+// identity returned always contains at least `user`. An error is only
+// returned when no entity could be resolved because lookups failed.
+func (v *Vault) ResolveIdentity(user string, tokens bool) (*audit.Identity, []EntityToken, error) {
+	if err := audit.ValidateUser(user); err != nil {
+		return nil, nil, err
+	}
+
+	var identity *audit.Identity = audit.NewIdentity(user)
+	client, err := v.roleClient()
+	if err != nil {
+		return identity, nil, err
+	}
+
+	var (
+		entities []string = make([]string, 0)
+		errs     []error  = make([]error, 0)
+	)
+	if id, err := lookupEntity(client, map[string]interface{}{"name": user}); err != nil {
+		log.Warnf("Unable to look up entity %s: %v", user, err)
+		errs = append(errs, err)
+	} else if id != "" {
+		entities = append(entities, id)
+	}
+
+	mounts, err := client.Sys().ListAuth()
+	if err != nil {
+		log.Warnf("Unable to list auth mounts: %v", err)
+		errs = append(errs, err)
+	}
+
+	accessors := make([]string, 0)
+	for p, m := range mounts {
+		identity.AddMount(p)
+		if m.Accessor != "" {
+			accessors = append(accessors, m.Accessor)
+		}
+	}
+
+	for _, accessor := range accessors {
+		id, err := lookupEntity(client, map[string]interface{}{
+			"alias_name":           user,
+			"alias_mount_accessor": accessor,
+		})
+		if err != nil {
+			log.Warnf("Unable to look up alias %s on %s: %v", user, accessor, err)
+			errs = append(errs, err)
+			continue
+		}
+		if id != "" {
+			entities = append(entities, id)
+		}
+	}
+
+	for _, id := range entities {
+		if err := readEntity(client, id, identity); err != nil {
+			log.Warnf("Unable to read entity %s: %v", id, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(identity.EntityIds) == 0 && len(errs) > 0 {
+		return identity, nil, fmt.Errorf("Unable to resolve any entity for %s: %w", user, errors.Join(errs...))
+	}
+
+	var found []EntityToken
+	if tokens && len(identity.EntityIds) > 0 {
+		var err error
+		if found, err = entityTokens(client, identity); err != nil {
+			log.Warnf("Unable to find tokens for %s: %v", user, err)
+		}
+		v.entityAccessors(client, identity, found)
+	}
+
+	log.Infof("Resolved %s to %d entities, %d names and %d accessors", user,
+		len(identity.EntityIds), len(identity.Names), len(identity.Accessors))
+	return identity, found, nil
+}
+
+// Look up the ID of an entity by name or alias
+//
+// Returns an empty ID if no entity matches.
+func lookupEntity(client *vault.Client, params map[string]interface{}) (string, error) {
+	secret, err := client.Logical().Write("identity/lookup/entity", params)
+	if err != nil {
+		return "", err
+	}
+
+	if secret == nil || secret.Data == nil {
+		return "", nil
+	}
+	id, _ := secret.Data["id"].(string)
+	return id, nil
+}
+
+// Add the names and IDs held by an entity to `identity`
+func readEntity(client *vault.Client, id string, identity *audit.Identity) error {
+	secret, err := client.Logical().Read(path.Join("identity/entity/id", id))
+	if err != nil {
+		return err
+	}
+
+	if secret == nil {
+		return fmt.Errorf("Entity not found")
+	}
+
+	identity.AddEntity(id)
+	if name, ok := secret.Data["name"].(string); ok {
+		identity.AddName(name)
+	}
+
+	if merged, ok := secret.Data["merged_entity_ids"].([]interface{}); ok {
+		for _, m := range merged {
+			if s, ok := m.(string); ok {
+				identity.AddEntity(s)
+			}
+		}
+	}
+
+	if aliases, ok := secret.Data["aliases"].([]interface{}); ok {
+		for _, a := range aliases {
+			alias, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name, ok := alias["name"].(string); ok {
+				identity.AddName(name)
+			}
+		}
+	}
+	return nil
+}
+
+// A live token issued to an entity
+type EntityToken struct {
+	Accessor string `json:"accessor"`
+	EntityId string `json:"entityId"`
+	// The path the token was created at
+	Path string `json:"path"`
+}
+
+// Check if the token was created from another token rather
+// than by logging in
+func (t *EntityToken) Created() bool {
+	return strings.HasPrefix(t.Path, "auth/token/create")
+}
+
+// Find the live tokens issued to the entities of `identity`
+//
+// Vault has no index of tokens by entity so every accessor is
+// looked up. This requires `sudo` on `auth/token/accessors`.
+func entityTokens(client *vault.Client, identity *audit.Identity) ([]EntityToken, error) {
+	secret, err := client.Logical().List("auth/token/accessors")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]EntityToken, 0)
+	if secret == nil {
+		return tokens, nil
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, k := range keys {
+		accessor, ok := k.(string)
+		if !ok {
+			continue
+		}
+
+		token, err := client.Auth().Token().LookupAccessor(accessor)
+		if err != nil || token == nil {
+			continue
+		}
+
+		entity, _ := token.Data["entity_id"].(string)
+		if entity == "" || !slices.Contains(identity.EntityIds, entity) {
+			continue
+		}
+
+		p, _ := token.Data["path"].(string)
+		tokens = append(tokens, EntityToken{
+			Accessor: accessor,
+			EntityId: entity,
+			Path:     p,
+		})
+	}
+	return tokens, nil
+}
+
+// Add the accessors of `tokens` issued to the entities of `identity`
+func (v *Vault) entityAccessors(client *vault.Client, identity *audit.Identity, tokens []EntityToken) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	devices, err := client.Sys().ListAudit()
+	if err != nil {
+		log.Warnf("Unable to list audit devices, accessors will not be hashed: %v", err)
+	}
+
+	for _, token := range tokens {
+		var accessor string = token.Accessor
+		identity.AddAccessor(accessor)
+		for _, device := range devices {
+			hash, err := client.Sys().AuditHash(strings.TrimSuffix(device.Path, "/"), accessor)
+			if err != nil {
+				log.Debugf("Unable to hash accessor with audit device %s: %v", device.Path, err)
+				continue
+			}
+			identity.AddAccessor(hash)
+		}
+	}
+}
+
+// Disable an entity so none of its tokens or aliases can be used
+//
+// Tokens are rejected while the entity is disabled but are not revoked.
+func (v *Vault) DisableEntity(id string) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Logical().Write(path.Join("identity/entity/id", id), map[string]interface{}{
+		"disabled": true,
+	})
+	return err
+}
+
+// Revoke a token, and every child of it, by accessor
+//
+// A token which no longer exists, as happens once its parent
+// has been revoked, is not an error.
+func (v *Vault) RevokeAccessor(accessor string) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	if err = client.Auth().Token().RevokeAccessor(accessor); err != nil && !isInvalidAccessor(err) {
+		return err
+	}
+	return nil
+}
+
+// Check if an error is vault refusing an accessor it does not hold
+func isInvalidAccessor(err error) bool {
+	var response *vault.ResponseError
+	if !errors.As(err, &response) || response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	for _, e := range response.Errors {
+		if strings.Contains(e, "invalid accessor") {
+			return true
+		}
+	}
+	return false
+}
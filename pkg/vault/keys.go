@@ -0,0 +1,370 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+// Versioning and rotation of the Thor encryption key
+//
+
+const (
+	KEY_HEADER  = "thor"
+	KEY_VERSION = "version"
+)
+
+type encryptionKeys struct {
+	current int
+	keys    map[int]string
+}
+
+// The outcome of rotating the Thor encryption key
+type KeyRotation struct {
+	Version int      `json:"version"`
+	Moved   []string `json:"moved"`
+	Failed  []string `json:"failed"`
+}
+
+// Get the name a key version is stored under
+//
+// The first version is stored as `apikey` for compatibility
+// with keys created before rotation was supported.
+func keyName(version int) string {
+	if version <= 1 {
+		return "apikey"
+	}
+	return fmt.Sprintf("apikey-v%d", version)
+}
+
+// Split a ciphertext into the key version and the encrypted value
+func keyVersion(ciphertext string) (int, string) {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) == 3 && parts[0] == KEY_HEADER && strings.HasPrefix(parts[1], "v") {
+		if version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v")); err == nil {
+			return version, parts[2]
+		}
+	}
+	return 1, ciphertext
+}
+
+// Load all available versions of the Thor encryption key
+//
+// Keys are cached after first load. Set `refresh` to
+// force the keys to be read again from vault.
+func (v *Vault) encryptionKeys(refresh bool) (*encryptionKeys, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil && !refresh {
+		return v.keys, nil
+	}
+
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Logical().Read(v.config.EncryptionKey)
+	if response == nil || err != nil {
+		return nil, err
+	}
+
+	keys := encryptionKeys{
+		current: 1,
+		keys:    make(map[int]string),
+	}
+
+	if c, ok := response.Data[KEY_VERSION].(string); ok {
+		if keys.current, err = strconv.Atoi(c); err != nil {
+			return nil, fmt.Errorf("Invalid encryption key version %q", c)
+		}
+	}
+
+	for name, value := range response.Data {
+		key, ok := value.(string)
+		if !ok {
+			continue
+		}
+		switch {
+		case name == keyName(1):
+			keys.keys[1] = key
+		case strings.HasPrefix(name, "apikey-v"):
+			if version, err := strconv.Atoi(strings.TrimPrefix(name, "apikey-v")); err == nil {
+				keys.keys[version] = key
+			}
+		}
+	}
+
+	if _, ok := keys.keys[keys.current]; !ok {
+		return nil, fmt.Errorf("No such entry created")
+	}
+
+	v.keys = &keys
+	return v.keys, nil
+}
+
+// Rotate the key used to encrypt Thor owned material
+//
+// A new key version is created and every entry in the secure path is
+// re-encrypted with it. Prior versions remain available for decryption
+// until every entry has been moved to the new version.
+func (v *Vault) RotateEncryptionKey() (*KeyRotation, error) {
+	if v.config.Transit != nil {
+		return v.rotateTransitKey()
+	}
+
+	keys, err := v.encryptionKeys(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys == nil {
+		return nil, fmt.Errorf("No encryption key has been created")
+	}
+
+	key, err := v.CreateEncryptionKey(v.config.TokenPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var version int = keys.current + 1
+	for k := range keys.keys {
+		if k >= version {
+			version = k + 1
+		}
+	}
+
+	// New versions are stored before being made current so
+	// that an interruption here leaves the old key in use
+	if err := v.writeInternal(keyName(version), key, v.config.EncryptionKey); err != nil {
+		return nil, err
+	}
+
+	if err := v.writeInternal(KEY_VERSION, strconv.Itoa(version), v.config.EncryptionKey); err != nil {
+		return nil, err
+	}
+
+	rotation := KeyRotation{
+		Version: version,
+		Moved:   make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+
+	// Entries still in the legacy format are moved to the envelope
+	if err := v.reencrypt(&rotation, v.migrateSecureEntry); err != nil {
+		return &rotation, err
+	}
+
+	if len(rotation.Failed) > 0 {
+		log.Warnf("Retaining prior encryption keys, %d entries could not be re-encrypted", len(rotation.Failed))
+		return &rotation, nil
+	}
+
+	var old []string = make([]string, 0)
+	for k := range keys.keys {
+		if k != version {
+			old = append(old, keyName(k))
+		}
+	}
+
+	if err := v.deleteInternal(old, v.config.EncryptionKey); err != nil {
+		return &rotation, fmt.Errorf("Entries moved to key version %d but prior keys could not be removed: %w", version, err)
+	}
+
+	if _, err := v.encryptionKeys(true); err != nil {
+		return &rotation, err
+	}
+	log.Infof("Encryption key rotated to version %d", version)
+	return &rotation, nil
+}
+
+// Rotate the transit key and rewrap every entry in the secure path
+//
+// Once every entry has been rewrapped, the minimum decryption
+// version of the key is raised to the new version.
+func (v *Vault) rotateTransitKey() (*KeyRotation, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var keyPath string = path.Join(v.config.Transit.Mount, "keys", v.config.Transit.Key)
+	if _, err = client.Logical().Write(path.Join(keyPath, "rotate"), nil); err != nil {
+		return nil, fmt.Errorf("Unable to rotate transit key: %w", err)
+	}
+
+	response, err := client.Logical().Read(keyPath)
+	if err != nil || response == nil {
+		return nil, fmt.Errorf("Unable to read transit key: %v", err)
+	}
+
+	latest, ok := response.Data["latest_version"].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("Unable to determine latest transit key version")
+	}
+
+	version, err := latest.Int64()
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := KeyRotation{
+		Version: int(version),
+		Moved:   make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+
+	if err := v.reencrypt(&rotation, func(_, ciphertext string) (string, error) {
+		response, err := client.Logical().Write(
+			path.Join(v.config.Transit.Mount, "rewrap", v.config.Transit.Key),
+			map[string]interface{}{
+				"ciphertext": ciphertext,
+			})
+		if err != nil {
+			return "", err
+		}
+
+		if response == nil {
+			return "", fmt.Errorf("Transit rewrap returned no data")
+		}
+
+		rewrapped, ok := response.Data["ciphertext"].(string)
+		if !ok {
+			return "", fmt.Errorf("Transit rewrap returned no ciphertext")
+		}
+		return rewrapped, nil
+	}); err != nil {
+		return &rotation, err
+	}
+
+	if len(rotation.Failed) > 0 {
+		log.Warnf("Retaining prior transit key versions, %d entries could not be rewrapped", len(rotation.Failed))
+		return &rotation, nil
+	}
+
+	if _, err := client.Logical().Write(path.Join(keyPath, "config"), map[string]interface{}{
+		"min_decryption_version": version,
+	}); err != nil {
+		return &rotation, fmt.Errorf("Entries moved to key version %d but minimum decryption version could not be raised: %w", version, err)
+	}
+	log.Infof("Transit key rotated to version %d", version)
+	return &rotation, nil
+}
+
+// Re-encrypt every entry in the secure path using `reencrypt`
+//
+// Each entry is re-encrypted on its own. As KV version 1 offers no
+// check-and-set, the entry is read again before writing and the work
+// repeated if the server has changed it in the meantime. Entries
+// removed in the meantime are skipped. Entries which fail are left
+// untouched and recorded against the rotation.
+func (v *Vault) reencrypt(rotation *KeyRotation, reencrypt func(key, ciphertext string) (string, error)) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Logical().List(v.config.SecureTokenPath)
+	if err != nil {
+		return err
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	keys, _ := response.Data["keys"].([]interface{})
+	for _, k := range keys {
+		job, ok := k.(string)
+		if !ok || strings.HasSuffix(job, "/") {
+			continue
+		}
+
+		moved, err := v.reencryptEntry(client, job, reencrypt)
+		if err != nil {
+			log.Errorf("Unable to re-encrypt %s: %v", job, err)
+			rotation.Failed = append(rotation.Failed, job)
+			continue
+		}
+
+		if moved {
+			rotation.Moved = append(rotation.Moved, job)
+		}
+	}
+	return nil
+}
+
+// Re-encrypt the token stored for a single job
+//
+// Returns false if the entry no longer exists.
+func (v *Vault) reencryptEntry(client *vault.Client, job string, reencrypt func(key, ciphertext string) (string, error)) (bool, error) {
+	var p string = v.secureEntryPath(job)
+
+	response, err := client.Logical().Read(p)
+	for attempt := 0; attempt <= CAS_RETRIES; attempt++ {
+		if err != nil {
+			return false, err
+		}
+
+		if response == nil {
+			return false, nil
+		}
+
+		ciphertext, ok := response.Data[SECURE_TOKEN_KEY].(string)
+		if !ok {
+			return false, fmt.Errorf("No token stored")
+		}
+
+		updated, err := reencrypt(job, ciphertext)
+		if err != nil {
+			return false, err
+		}
+
+		var current *vault.Secret
+		if current, err = client.Logical().Read(p); err != nil {
+			return false, err
+		}
+
+		if current == nil {
+			return false, nil
+		}
+
+		if token, _ := current.Data[SECURE_TOKEN_KEY].(string); token != ciphertext {
+			response = current
+			continue
+		}
+
+		data := make(map[string]interface{})
+		for key, value := range current.Data {
+			data[key] = value
+		}
+		data[SECURE_TOKEN_KEY] = updated
+
+		if _, err = client.Logical().Write(p, data); err != nil {
+			return false, fmt.Errorf("Unable to store re-encrypted entry: %w", err)
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("Entry was modified by another writer")
+}
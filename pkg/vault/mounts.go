@@ -0,0 +1,155 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/notapipeline/thor/pkg/kv"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolve a single path to the KV mount it is held in
+//
+// This uses the same preflight endpoint as the Vault UI which is
+// available to any token holding a capability on the path, so does
+// not require access to the mount table.
+func (v *Vault) resolve(client *vault.Client, p string) (*kv.Secret, error) {
+	secret, err := client.Logical().Read(path.Join("sys/internal/ui/mounts", kv.Clean(p)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve mount for %s: %w", p, err)
+	}
+
+	if secret == nil {
+		return nil, fmt.Errorf("No mount found for %s", p)
+	}
+
+	if t, _ := secret.Data["type"].(string); t != "kv" {
+		return nil, fmt.Errorf("%s is not held in a KV mount", p)
+	}
+
+	mount, ok := secret.Data["path"].(string)
+	if !ok || mount == "" {
+		return nil, fmt.Errorf("No mount found for %s", p)
+	}
+
+	return kv.Split(kv.Mount{
+		Path:    kv.Clean(mount) + "/",
+		Version: kv.Version(secret.Data),
+	}, p), nil
+}
+
+// Gets a resolver over every KV mount in the namespace the client is bound to
+func (v *Vault) resolver(client *vault.Client) (*kv.Resolver, error) {
+	log.Debug("Getting mount points")
+	mounts, err := client.Logical().Read("/sys/mounts")
+	if err != nil {
+		return nil, err
+	}
+
+	if mounts == nil {
+		return nil, fmt.Errorf("Unable to read mounts for namespace")
+	}
+
+	log.Debugf("Found %d mounts", len(mounts.Data))
+	return kv.NewResolver(kv.ParseMounts(mounts.Data)), nil
+}
+
+// Reads a secret using the backend login for the Thor server
+//
+// Only string values are returned.
+func (v *Vault) ReadSecret(p string) (map[string]string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := v.resolve(client, p)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Logical().Read(key.DataPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return nil, fmt.Errorf("No secret found at %s", p)
+	}
+
+	values := make(map[string]string)
+	for k, value := range secretData(secret, key.V2()) {
+		if s, ok := value.(string); ok {
+			values[k] = s
+		}
+	}
+	return values, nil
+}
+
+// Get the replaceable keys held by a secret
+//
+// For KV version 2 the key names are read from the `subkeys` endpoint
+// so no secret values are read, falling back to the secret itself
+// where `subkeys` is not available.
+func (v *Vault) ReplaceableKeys(namespace, p string) ([]string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace != "" && namespace != "root" {
+		client.SetNamespace(namespace)
+	}
+
+	key, err := v.resolve(client, p)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if key.V2() {
+		if secret, err := client.Logical().Read(key.SubkeysPath()); err == nil && secret != nil {
+			data, _ = secret.Data["subkeys"].(map[string]interface{})
+		}
+	}
+
+	if data == nil {
+		secret, err := client.Logical().Read(key.DataPath())
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil {
+			return nil, fmt.Errorf("No secret found at %s", p)
+		}
+		data = secretData(secret, key.V2())
+	}
+
+	keys := make([]string, 0)
+	for k := range data {
+		if slices.Contains(v.config.Replaceable, k) && k != LEGACY_ROTATED_KEY {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
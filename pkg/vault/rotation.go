@@ -0,0 +1,233 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/notapipeline/thor/pkg/kv"
+)
+
+//
+// Rotation bookkeeping
+//
+// The keys rotated at a secret are recorded outside of the secret data so
+// application secrets are never modified beyond the keys being rotated. For
+// KV version 2 this is held in the custom metadata of the secret, for KV
+// version 1 in a Thor owned shadow path mirroring the secret path.
+//
+
+const (
+	REASON_EX_EMPLOYEE = "ex-employee"
+	REASON_COMPROMISED = "compromised"
+	REASON_MANUAL      = "manual"
+
+	// Key rotation state was recorded under in the secret data before
+	// it moved to metadata. It is never offered for or changed by rotation.
+	LEGACY_ROTATED_KEY = "rotated"
+
+	METADATA_PREFIX     = "thor-"
+	METADATA_ROTATED    = METADATA_PREFIX + "rotated"
+	METADATA_ROTATED_AT = METADATA_PREFIX + "rotated-at"
+	METADATA_REASON     = METADATA_PREFIX + "reason"
+	METADATA_JOB        = METADATA_PREFIX + "job"
+	METADATA_REQUESTER  = METADATA_PREFIX + "requester"
+)
+
+// The rotation job a secret is being rotated under
+type RotationJob struct {
+	ID        string
+	Reason    string
+	Requester string
+}
+
+// Rotation state held against a single secret
+type RotationRecord struct {
+	Keys      []string  `json:"keys"`
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	Job       string    `json:"job"`
+	Requester string    `json:"requester"`
+}
+
+func (r *RotationRecord) toMap() map[string]string {
+	return map[string]string{
+		METADATA_ROTATED:    strings.Join(r.Keys, ","),
+		METADATA_ROTATED_AT: r.Time.UTC().Format(time.RFC3339),
+		METADATA_REASON:     r.Reason,
+		METADATA_JOB:        r.Job,
+		METADATA_REQUESTER:  r.Requester,
+	}
+}
+
+func recordFromMap(m map[string]interface{}) *RotationRecord {
+	var record RotationRecord = RotationRecord{
+		Keys: make([]string, 0),
+	}
+
+	if rotated, ok := m[METADATA_ROTATED].(string); ok {
+		for _, k := range strings.Split(rotated, ",") {
+			if k != "" {
+				record.Keys = append(record.Keys, k)
+			}
+		}
+	}
+
+	if t, ok := m[METADATA_ROTATED_AT].(string); ok {
+		record.Time, _ = time.Parse(time.RFC3339, t)
+	}
+	record.Reason, _ = m[METADATA_REASON].(string)
+	record.Job, _ = m[METADATA_JOB].(string)
+	record.Requester, _ = m[METADATA_REQUESTER].(string)
+	return &record
+}
+
+// The path rotation state of a KV version 1 secret is kept at
+func (v *Vault) shadowPath(secret *kv.Secret) (string, error) {
+	if v.config.ShadowPath == "" {
+		return "", fmt.Errorf("No shadow path configured for KV version 1 rotation state")
+	}
+	return kv.Clean(path.Join(v.config.ShadowPath, secret.Mount.Path, secret.Key)), nil
+}
+
+// Paths a device must be able to read to discover rotated keys at `secret`
+func (v *Vault) recordPaths(secret *kv.Secret) []string {
+	if secret.V2() {
+		return []string{secret.MetadataPath()}
+	}
+
+	if shadow, err := v.shadowPath(secret); err == nil {
+		return []string{shadow}
+	}
+	return []string{}
+}
+
+// Read the rotation record for a secret
+func (v *Vault) readRecord(client *vault.Client, key *kv.Secret) (*RotationRecord, error) {
+	if key.V2() {
+		secret, err := client.Logical().Read(key.MetadataPath())
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil {
+			return recordFromMap(nil), nil
+		}
+
+		custom, _ := secret.Data["custom_metadata"].(map[string]interface{})
+		return recordFromMap(custom), nil
+	}
+
+	shadow, err := v.shadowPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Logical().Read(shadow)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return recordFromMap(nil), nil
+	}
+	return recordFromMap(secret.Data), nil
+}
+
+// Write the rotation record for a secret
+//
+// For KV version 2, custom metadata not owned by Thor is preserved.
+// A nil record removes all rotation state from the secret.
+func (v *Vault) writeRecord(client *vault.Client, key *kv.Secret, record *RotationRecord) error {
+	if key.V2() {
+		var metadataPath string = key.MetadataPath()
+		secret, err := client.Logical().Read(metadataPath)
+		if err != nil {
+			return err
+		}
+
+		custom := make(map[string]interface{})
+		if secret != nil {
+			if existing, ok := secret.Data["custom_metadata"].(map[string]interface{}); ok {
+				for k, v := range existing {
+					if !strings.HasPrefix(k, METADATA_PREFIX) {
+						custom[k] = v
+					}
+				}
+			}
+		}
+
+		if record != nil {
+			for k, v := range record.toMap() {
+				custom[k] = v
+			}
+		}
+
+		_, err = client.Logical().Write(metadataPath, map[string]interface{}{
+			"custom_metadata": custom,
+		})
+		return err
+	}
+
+	shadow, err := v.shadowPath(key)
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		_, err = client.Logical().Delete(shadow)
+		return err
+	}
+
+	data := make(map[string]interface{})
+	for k, v := range record.toMap() {
+		data[k] = v
+	}
+	_, err = client.Logical().Write(shadow, data)
+	return err
+}
+
+// Add keys rotated by `job` to the rotation record of a secret
+//
+// Keys recorded by a previous job are replaced.
+func (v *Vault) recordRotation(client *vault.Client, key *kv.Secret, job RotationJob, keys []string) error {
+	record, err := v.readRecord(client, key)
+	if err != nil {
+		return err
+	}
+
+	if record.Job != job.ID {
+		record.Keys = make([]string, 0)
+	}
+
+	for _, k := range keys {
+		if !slices.Contains(record.Keys, k) {
+			record.Keys = append(record.Keys, k)
+		}
+	}
+
+	record.Time = time.Now()
+	record.Reason = job.Reason
+	record.Job = job.ID
+	record.Requester = job.Requester
+	return v.writeRecord(client, key, record)
+}
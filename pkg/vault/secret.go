@@ -18,8 +18,8 @@ package vault
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path"
 
 	vault "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
@@ -28,85 +28,236 @@ import (
 //
 // Handles rotation of the approle-secret ID
 //
+// A rotation always creates and verifies the new secret-id before it
+// is persisted and only destroys the old secret-id once the new one
+// has been saved. If the old secret-id cannot be destroyed, its
+// accessor is retained in config and destroyed on the next rotation.
+//
+
+// Applies `update` to the config and persists it
+//
+// The config is shared with the rest of the server so it is only
+// changed from within `update`, which is called under the config lock.
+type SaveFunc func(update func()) error
 
-func (v *Vault) rotateAppRoleSecret() {
+// Initialise the AppRole credentials from an initialisation token
+//
+// This only applies when neither a role-id nor secret-id has been
+// configured. `save` is called to persist the new credentials.
+func (v *Vault) InitialiseAppRole(save SaveFunc) error {
 	if v.config.AppRole == nil {
 		// not using approle
-		return
+		return nil
 	}
 	roleConfig := v.config.AppRole
 
-	if roleConfig.InitialisationToken != "" {
-		if roleConfig.RoleId == "" && roleConfig.SecretId == "" {
-			v.initialiseAppRole()
+	if roleConfig.InitialisationToken == "" || roleConfig.RoleId != "" || roleConfig.SecretId != "" {
+		return nil
+	}
+
+	// initialisation token may be a vault token or a path to file
+	var tokenFile string
+	if _, err := os.Stat(roleConfig.InitialisationToken); err == nil {
+		token, err := os.ReadFile(roleConfig.InitialisationToken)
+		if err != nil {
+			return fmt.Errorf("Failed to read initialisation token: %w", err)
+		}
+		tokenFile = roleConfig.InitialisationToken
+		roleConfig.InitialisationToken = string(token)
+	}
+
+	client, err := v.tokenClient(roleConfig.InitialisationToken, v.config.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if err = v.handleRotation(client, save); err != nil {
+		return err
+	}
+
+	if tokenFile != "" {
+		if err = os.Remove(tokenFile); err != nil {
+			// non-fatal
+			log.Errorf("Failed to delete initialisation token file: %v", err)
 		}
 	}
+	return nil
 }
 
-func (v *Vault) initialiseAppRole() {
-	roleConfig := v.config.AppRole
+// Rotate the secret-id Thor logs in with
+//
+// `save` is called to persist the new secret-id. If it fails,
+// the new secret-id is destroyed and the existing one retained.
+func (v *Vault) RotateAppRoleSecret(save SaveFunc) error {
+	if v.config.AppRole == nil {
+		return nil
+	}
 
-	// initialisation token may be a vault token or a path to file
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+	return v.handleRotation(client, save)
+}
+
+// Find the name and mount of the role Thor logs in with
+//
+// Configured values are preferred, then the metadata of the token
+// Thor holds. An initialisation token is not an AppRole login so
+// finally the `role-name` and `mount-name` held with the encryption
+// key are used.
+func (v *Vault) appRoleName(client *vault.Client) (string, string, error) {
 	var (
-		token  []byte = []byte(roleConfig.InitialisationToken)
-		err    error
-		client *vault.Client
+		mount string = v.config.AppRole.Mount
+		name  string = v.config.AppRole.RoleName
 	)
 
-	if _, err = os.Stat(roleConfig.InitialisationToken); err == nil {
-		token, err = ioutil.ReadFile(roleConfig.InitialisationToken)
+	if name == "" {
+		secret, err := client.Auth().Token().LookupSelf()
 		if err != nil {
-			log.Error("Failed to read initialisation token")
-			return
+			return "", "", fmt.Errorf("Unable to lookup role name: %w", err)
 		}
-		if err = os.Remove(roleConfig.InitialisationToken); err != nil {
-			// non-fatal
-			log.Error("Failed to delete initialisation token file")
+
+		if metadata, ok := secret.Data["meta"].(map[string]interface{}); ok {
+			name, _ = metadata["role_name"].(string)
 		}
-		roleConfig.InitialisationToken = string(token)
 	}
 
-	client, err = v.tokenClient(roleConfig.InitialisationToken, v.config.Namespace)
-	if err != nil {
-		log.Error(err)
-		return
+	if name == "" && v.config.EncryptionKey != "" {
+		secret, err := client.Logical().Read(v.config.EncryptionKey)
+		if err != nil {
+			log.Warnf("Unable to read role name from %s: %v", v.config.EncryptionKey, err)
+		} else if secret != nil {
+			name, _ = secret.Data["role-name"].(string)
+			if m, ok := secret.Data["mount-name"].(string); ok && m != "" && name != "" {
+				mount = m
+			}
+		}
+	}
+
+	if name == "" {
+		return "", "", fmt.Errorf("Unable to determine approle name. Please set `roleName` in the appRole config")
 	}
-	v.handleRotation(client)
+	return mount, name, nil
 }
 
-func (v *Vault) handleRotation(client *vault.Client) {
+func (v *Vault) handleRotation(client *vault.Client, save SaveFunc) error {
 	var (
-		secret *vault.Secret
-		err    error
+		secret     *vault.Secret
+		err        error
+		roleConfig = v.config.AppRole
 	)
-	roleConfig := v.config.AppRole
 
-	if secret, err = client.Logical().Read(v.config.EncryptionKey); err != nil {
-		log.Error(err)
-		return
+	mount, name, err := v.appRoleName(client)
+	if err != nil {
+		return err
+	}
+
+	var rolePath string = path.Join("auth", mount, "role", name)
+
+	// An accessor left over from a partially failed rotation
+	if roleConfig.PreviousSecretIdAccessor != "" {
+		if err = v.destroySecretId(client, rolePath, roleConfig.PreviousSecretIdAccessor); err != nil {
+			log.Warnf("Unable to destroy previous secret-id: %v", err)
+		} else if err = save(func() {
+			roleConfig.PreviousSecretIdAccessor = ""
+		}); err != nil {
+			log.Warnf("Unable to save config: %v", err)
+		}
+	}
+
+	var roleId string = roleConfig.RoleId
+	if roleId == "" {
+		if secret, err = client.Logical().Read(path.Join(rolePath, "role-id")); err != nil || secret == nil {
+			return fmt.Errorf("Unable to read role-id: %v", err)
+		}
+		roleId, _ = secret.Data["role_id"].(string)
+	}
+
+	if secret, err = client.Logical().Write(path.Join(rolePath, "secret-id"), map[string]interface{}{
+		"cidr_list": []string{},
+	}); err != nil || secret == nil {
+		return fmt.Errorf("Unable to create secret id: %v", err)
 	}
 
 	var (
-		mount        = "approle"
-		name  string = secret.Data["role-name"].(string)
+		secretId, _ = secret.Data["secret_id"].(string)
+		accessor, _ = secret.Data["secret_id_accessor"].(string)
 	)
+	if secretId == "" || accessor == "" {
+		return fmt.Errorf("No secret-id was returned for role %s", name)
+	}
 
-	if m, ok := secret.Data["mount-name"]; ok {
-		mount = m.(string)
+	// Make sure the new secret-id works before anything is changed
+	login, err := v.loginClient(v.config.VaultConfig)
+	if err != nil {
+		return v.abandonSecretId(client, rolePath, accessor, err)
+	}
+
+	if _, err = v.writeLogin(login, path.Join("auth", mount, "login"), "approle", map[string]interface{}{
+		"role_id":   roleId,
+		"secret_id": secretId,
+	}); err != nil {
+		return v.abandonSecretId(client, rolePath, accessor, err)
+	}
+
+	var previous = *roleConfig
+	if err = save(func() {
+		v.clientMu.Lock()
+		defer v.clientMu.Unlock()
+		roleConfig.RoleId = roleId
+		roleConfig.SecretId = secretId
+		roleConfig.SecretIdAccessor = accessor
+		roleConfig.ResponseWrapped = false
+		roleConfig.InitialisationToken = ""
+		if previous.SecretIdAccessor != "" {
+			roleConfig.PreviousSecretIdAccessor = previous.SecretIdAccessor
+		}
+	}); err != nil {
+		// Restoring the previous credentials writes back what was
+		// last saved so failing to save them again is not an error
+		if e := save(func() {
+			v.clientMu.Lock()
+			defer v.clientMu.Unlock()
+			*roleConfig = previous
+		}); e != nil {
+			log.Debugf("Unable to save restored config: %v", e)
+		}
+		return v.abandonSecretId(client, rolePath, accessor, fmt.Errorf("Unable to save config: %w", err))
 	}
+	log.Infof("Rotated secret-id for approle %s", name)
 
-	if secret, err = client.Logical().Read(fmt.Sprintf("auth/%s/role/%s/role-id", mount, name)); err != nil {
-		log.Fatalf("Unable to read role-id: %v", err)
-		return
+	if previous.SecretIdAccessor == "" {
+		if previous.SecretId != "" {
+			log.Warnf("No accessor is known for the previous secret-id of approle %s. It must be destroyed manually", name)
+		}
+		return nil
 	}
-	roleConfig.RoleId = secret.Data["data"].(map[string]interface{})["role-id"].(string)
 
-	var cidrs []string = []string{}
-	var config map[string]interface{} = make(map[string]interface{})
-	config["cidr_list"] = cidrs
-	if secret, err = client.Logical().Write(fmt.Sprintf("auth/%s/role/%s/secret-id", mount, name), config); err != nil {
-		log.Fatalf("Unable to create secret id %v", err)
-		return
+	if err = v.destroySecretId(client, rolePath, previous.SecretIdAccessor); err != nil {
+		return fmt.Errorf("New secret-id saved but the previous secret-id could not be destroyed, retrying on next rotation: %w", err)
+	}
+
+	if err = save(func() {
+		roleConfig.PreviousSecretIdAccessor = ""
+	}); err != nil {
+		log.Warnf("Unable to save config: %v", err)
+	}
+	return nil
+}
+
+// Destroy a secret-id by its accessor
+func (v *Vault) destroySecretId(client *vault.Client, rolePath, accessor string) error {
+	_, err := client.Logical().Write(path.Join(rolePath, "secret-id-accessor", "destroy"), map[string]interface{}{
+		"secret_id_accessor": accessor,
+	})
+	return err
+}
+
+// Destroy a newly created secret-id which will not be used
+func (v *Vault) abandonSecretId(client *vault.Client, rolePath, accessor string, cause error) error {
+	if err := v.destroySecretId(client, rolePath, accessor); err != nil {
+		log.Errorf("Unable to destroy unused secret-id: %v", err)
 	}
-	roleConfig.SecretId = secret.Data["data"].(map[string]interface{})["secret-id"].(string)
+	return fmt.Errorf("Secret-id rotation failed: %w", cause)
 }
@@ -0,0 +1,109 @@
+// This file is part of thor (https://github.com/notapipeline/thor).
+//
+// Copyright (c) 2024 Martin Proffitt <mproffitt@choclab.net>.
+//
+// This program is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// this program. If not, see <https://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+)
+
+//
+// Encryption of Thor owned material through the Vault transit engine
+//
+
+// Ensure the transit key exists, creating it if not
+func (v *Vault) transitInit() error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	var keyPath string = path.Join(v.config.Transit.Mount, "keys", v.config.Transit.Key)
+	response, err := client.Logical().Read(keyPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read transit key %s: %w", keyPath, err)
+	}
+
+	if response != nil {
+		return nil
+	}
+
+	if _, err = client.Logical().Write(keyPath, map[string]interface{}{
+		"type": "aes256-gcm96",
+	}); err != nil {
+		return fmt.Errorf("Unable to create transit key %s: %w", keyPath, err)
+	}
+	return nil
+}
+
+func (v *Vault) transitEncrypt(what string) (string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.Logical().Write(
+		path.Join(v.config.Transit.Mount, "encrypt", v.config.Transit.Key),
+		map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString([]byte(what)),
+		})
+	if err != nil {
+		return "", fmt.Errorf("Transit encryption failed: %w", err)
+	}
+
+	if response == nil {
+		return "", fmt.Errorf("Transit encryption returned no data")
+	}
+
+	ciphertext, ok := response.Data["ciphertext"].(string)
+	if !ok {
+		return "", fmt.Errorf("Transit encryption returned no ciphertext")
+	}
+	return ciphertext, nil
+}
+
+func (v *Vault) transitDecrypt(what string) (string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.Logical().Write(
+		path.Join(v.config.Transit.Mount, "decrypt", v.config.Transit.Key),
+		map[string]interface{}{
+			"ciphertext": what,
+		})
+	if err != nil {
+		return "", fmt.Errorf("Transit decryption failed: %w", err)
+	}
+
+	if response == nil {
+		return "", fmt.Errorf("Transit decryption returned no data")
+	}
+
+	encoded, ok := response.Data["plaintext"].(string)
+	if !ok {
+		return "", fmt.Errorf("Transit decryption returned no plaintext")
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode transit plaintext: %w", err)
+	}
+	return string(plaintext), nil
+}
@@ -18,36 +18,66 @@ package vault
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"path"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/notapipeline/thor/pkg/config"
+	"github.com/notapipeline/thor/pkg/kv"
 	"github.com/notapipeline/thor/pkg/loki"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	TTL     = "5m"
-	MAX_TTL = "5m"
-	STANDBY = "standby"
+	TTL           = "5m"
+	MAX_TTL       = "5m"
+	STANDBY       = "standby"
+	POLICY_PREFIX = "thor-rotation-"
+
+	// Keys a rotation token and the time it was stored are held
+	// under at its secure path entry
+	SECURE_TOKEN_KEY   = "token"
+	SECURE_CREATED_KEY = "created"
 )
 
 type Result struct {
 	Path string
 }
 
+// A rotation token held in the secure token path
+type SecureEntry struct {
+	Job string
+
+	// When the token was stored. Zero for entries
+	// stored before this was recorded.
+	Created time.Time
+}
+
 type Vault struct {
-	config        *config.VaultConfig
-	encryptionkey string
+	config *config.VaultConfig
+	keys   *encryptionKeys
+	mu     sync.Mutex
+
+	client   *vault.Client
+	watcher  *vault.LifetimeWatcher
+	expires  time.Time
+	clientMu sync.Mutex
+
+	token   string
+	tokenMu sync.RWMutex
 }
 
 func NewVault(c *config.VaultConfig) *Vault {
 	v := Vault{
 		config: c,
 	}
+	v.relogin(c.VaultConfig)
 	return &v
 }
 
@@ -57,6 +87,10 @@ func (v *Vault) Init() error {
 		err error
 	)
 
+	if v.config.Transit != nil {
+		return v.transitInit()
+	}
+
 	if key, err = v.GetEncryptionKey(); err != nil || key == "" {
 		if key, err = v.CreateEncryptionKey(v.config.TokenPolicy); err != nil {
 			return err
@@ -70,6 +104,9 @@ func (v *Vault) Init() error {
 
 func (v *Vault) CreateEncryptionKey(policy *config.Policy) (string, error) {
 	client, err := v.roleClient()
+	if err != nil {
+		return "", err
+	}
 	s, err := client.Logical().Write("gen/password", map[string]interface{}{})
 	if err != nil {
 		return "", err
@@ -88,26 +125,16 @@ func (v *Vault) CreateEncryptionKey(policy *config.Policy) (string, error) {
 }
 
 func (v *Vault) StoreEncryptionKey(key string) error {
-	return v.writeInternal("apikey", key, v.config.EncryptionKey)
+	return v.writeInternal(keyName(1), key, v.config.EncryptionKey)
 }
 
+// Get the current version of the Thor encryption key
 func (v *Vault) GetEncryptionKey() (string, error) {
-	if v.encryptionkey == "" {
-		client, err := v.roleClient()
-		if err != nil {
-			return "", err
-		}
-		response, err := client.Logical().Read(v.config.EncryptionKey)
-		if response == nil || err != nil {
-			return "", err
-		}
-
-		if _, ok := response.Data["apikey"].(string); !ok {
-			return "", fmt.Errorf("No such entry created")
-		}
-		v.encryptionkey = response.Data["apikey"].(string)
+	keys, err := v.encryptionKeys(false)
+	if err != nil || keys == nil {
+		return "", err
 	}
-	return v.encryptionkey, nil
+	return keys.keys[keys.current], nil
 }
 
 // Unwrap a response wrapped token - used in the agent
@@ -150,30 +177,65 @@ func (v *Vault) Wrap(what interface{}) (string, error) {
 
 // Store an orphaned child token based on the token used to request rotation
 //
-// This token will have a specific read only policy created against it but the ability
-// to create child tokens.
-func (v *Vault) CreateAndStoreChildCreationToken(token, namespace string, policyPaths []string) error {
+// This token will have a policy allowing it to create child tokens and nothing else.
+// Each device in `devices` is given its own read only policy covering only those
+// selected paths the device is mapped to and each of these is attached to the parent
+// so it may hand them down to the device. Tokens are stored against the rotation job
+// they were created for so that concurrent rotations in the same namespace do not
+// overwrite each other.
+//
+// The names of all policies created for the job are returned.
+func (v *Vault) CreateAndStoreChildCreationToken(token, namespace, job string, policyPaths []string, devices map[string][]string) ([]string, error) {
 	client, err := v.tokenClient(token, namespace)
+	if err != nil {
+		return nil, err
+	}
 
 	var (
 		policy    string = "path \"auth/token/create\" {\n  capabilities = [\"create\", \"update\"]\n}\n\n"
 		renewable bool   = false
 	)
-	for _, path := range policyPaths {
-		policy += fmt.Sprintf("path \"%s\" {\n  capabilities = [\"list\", \"read\"]\n}\n\n", path)
-	}
 
 	// store new policy into namespace
-	t := time.Now()
-	policyName := fmt.Sprintf("rotation-policy-%s", t.Format("2006-01-02-15-04"))
+	policyName := fmt.Sprintf("%s%s", POLICY_PREFIX, job)
 	if err := client.Sys().PutPolicy(policyName, policy); err != nil {
-		return err
+		return nil, err
+	}
+
+	var policies []string = []string{policyName}
+	for device, paths := range devices {
+		var devicePolicy string
+		for _, path := range v.intersect(client, paths, policyPaths) {
+			var readable []string = []string{path}
+
+			// Devices also need to read where rotated keys are recorded
+			if secret, err := v.resolve(client, path); err == nil {
+				readable = append([]string{secret.DataPath()}, v.recordPaths(secret)...)
+			} else {
+				log.Warnf("Device %s: %v", device, err)
+			}
+
+			for _, p := range readable {
+				devicePolicy += fmt.Sprintf("path \"%s\" {\n  capabilities = [\"read\"]\n}\n\n", p)
+			}
+		}
+
+		if devicePolicy == "" {
+			log.Debugf("Device %s has no paths selected in job %s", device, job)
+			continue
+		}
+
+		name := devicePolicyName(job, device)
+		if err := client.Sys().PutPolicy(name, devicePolicy); err != nil {
+			return policies, fmt.Errorf("Failed to create policy for device %s: %w", device, err)
+		}
+		policies = append(policies, name)
 	}
 
-	// Create a new child token, orphaned, with the new policy attached to it
+	// Create a new child token, orphaned, with the new policies attached to it
 	childTokenLease, err := client.Auth().Token().Create(&vault.TokenCreateRequest{
 		DisplayName:    fmt.Sprintf("Auto-Rotation-Parent-%s", policyName),
-		Policies:       []string{policyName},
+		Policies:       policies,
 		NoParent:       true,
 		TTL:            TTL,
 		ExplicitMaxTTL: MAX_TTL,
@@ -182,16 +244,97 @@ func (v *Vault) CreateAndStoreChildCreationToken(token, namespace string, policy
 	})
 
 	if err != nil {
-		return fmt.Errorf("Failed to create a limited child token for namespace %s: %s", namespace, err)
+		return policies, fmt.Errorf("Failed to create a limited child token for job %s in namespace %s: %s", job, namespace, err)
 	}
 
-	key, err := v.GetEncryptionKey()
+	encrypted, err := v.encryptInternal(childTokenLease.Auth.ClientToken, secureTokenData(job))
+	if err != nil {
+		return policies, err
+	}
+	return policies, v.writeSecureEntry(job, encrypted)
+}
+
+// Delete a list of policies from a namespace using the backend login
+// for the Thor server.
+func (v *Vault) DeletePolicies(namespace string, policies []string) error {
+	client, err := v.roleClient()
 	if err != nil {
 		return err
 	}
 
-	var encrypted string = v.Encrypt(childTokenLease.Auth.ClientToken, key)
-	return v.writeInternal(namespace, encrypted, v.config.SecureTokenPath)
+	if namespace != "" && namespace != "root" {
+		client.SetNamespace(namespace)
+	}
+
+	var errs []error = make([]error, 0)
+	for _, policy := range policies {
+		if err := client.Sys().DeletePolicy(policy); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", policy, err))
+			continue
+		}
+		log.Infof("Deleted policy %s from namespace %s", policy, namespace)
+	}
+	return errors.Join(errs...)
+}
+
+// List the names of all policies in a namespace using the backend login
+// for the Thor server.
+func (v *Vault) ListPolicies(namespace string) ([]string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace != "" && namespace != "root" {
+		client.SetNamespace(namespace)
+	}
+	return client.Sys().ListPolicies()
+}
+
+// Get the name of the policy created for a device during a rotation job
+func devicePolicyName(job, device string) string {
+	reg := regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+	return fmt.Sprintf("%s%s-%s", POLICY_PREFIX, job, reg.ReplaceAllString(device, "-"))
+}
+
+// Gets the list of paths found in both `a` and `b`
+//
+// Paths are compared by the data path of the secret they address so a
+// KV version 2 secret given by its logical path matches the same secret
+// given by its data path. Paths which cannot be resolved are compared as
+// given, ignoring leading and trailing slashes.
+func (v *Vault) intersect(client *vault.Client, a, b []string) []string {
+	var resolved map[string]string = make(map[string]string)
+	normalise := func(p string) string {
+		p = strings.Trim(p, "/")
+		if r, ok := resolved[p]; ok {
+			return r
+		}
+
+		resolved[p] = p
+		if p == "" {
+			return p
+		}
+
+		if secret, err := v.resolve(client, p); err == nil {
+			resolved[p] = strings.Trim(secret.DataPath(), "/")
+		} else {
+			log.Debugf("Comparing %s as given: %v", p, err)
+		}
+		return resolved[p]
+	}
+
+	var paths []string = make([]string, 0)
+	for _, x := range a {
+		x = normalise(x)
+		for _, y := range b {
+			if x != "" && x == normalise(y) {
+				paths = append(paths, x)
+				break
+			}
+		}
+	}
+	return paths
 }
 
 // Writes to a KV version 1 store using the backend login
@@ -222,35 +365,167 @@ func (v *Vault) writeInternal(key, value, path string) error {
 	return nil
 }
 
+// Removes a list of keys from a KV version 1 store using the backend
+// login for the Thor server.
+//
+// If no keys remain at the path once removed, the path is deleted.
+func (v *Vault) deleteInternal(keys []string, path string) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+	response, err := client.Logical().Read(path)
+	if err != nil || response == nil {
+		return err
+	}
+
+	for _, key := range keys {
+		delete(response.Data, key)
+	}
+
+	if len(response.Data) == 0 {
+		_, err = client.Logical().Delete(path)
+		return err
+	}
+
+	_, err = client.Logical().Write(path, response.Data)
+	return err
+}
+
+// Get the path the rotation token for `job` is stored at
+//
+// Each job has its own secret beneath the secure token path so
+// concurrent jobs never read and rewrite each other's tokens.
+func (v *Vault) secureEntryPath(job string) string {
+	return path.Join(v.config.SecureTokenPath, job)
+}
+
+// Store the encrypted rotation token for `job`
+func (v *Vault) writeSecureEntry(job, token string) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Logical().Write(v.secureEntryPath(job), map[string]interface{}{
+		SECURE_TOKEN_KEY:   token,
+		SECURE_CREATED_KEY: time.Now().UTC().Format(time.RFC3339),
+	})
+	return err
+}
+
+// Read the encrypted rotation token stored for `job`
+//
+// Returns an empty string if no token is stored.
+func (v *Vault) readSecureEntry(job string) (string, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.Logical().Read(v.secureEntryPath(job))
+	if err != nil || response == nil {
+		return "", err
+	}
+
+	token, _ := response.Data[SECURE_TOKEN_KEY].(string)
+	return token, nil
+}
+
+// Get the list of tokens held in the secure token path
+func (v *Vault) SecureEntries() ([]SecureEntry, error) {
+	client, err := v.roleClient()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Logical().List(v.config.SecureTokenPath)
+	if err != nil || response == nil {
+		return nil, err
+	}
+
+	var (
+		entries []SecureEntry = make([]SecureEntry, 0)
+		errs    []error       = make([]error, 0)
+	)
+	keys, _ := response.Data["keys"].([]interface{})
+	for _, key := range keys {
+		job, ok := key.(string)
+		if !ok || strings.HasSuffix(job, "/") {
+			continue
+		}
+
+		secret, err := client.Logical().Read(v.secureEntryPath(job))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", job, err))
+			continue
+		}
+
+		// Deleted since being listed
+		if secret == nil {
+			continue
+		}
+
+		entry := SecureEntry{Job: job}
+		if created, ok := secret.Data[SECURE_CREATED_KEY].(string); ok {
+			entry.Created, _ = time.Parse(time.RFC3339, created)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Join(errs...)
+}
+
+// Delete the tokens stored for `entries` from the secure token path
+func (v *Vault) DeleteSecureEntries(entries []string) error {
+	client, err := v.roleClient()
+	if err != nil {
+		return err
+	}
+
+	var errs []error = make([]error, 0)
+	for _, entry := range entries {
+		if _, err := client.Logical().Delete(v.secureEntryPath(entry)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Get a response wrapped token for client usage
-func (v *Vault) GetToken(namespace, encryptionKey string) (string, error) {
+//
+// The token is created from the rotation credentials stored for `job`
+// and carries only the policy created for `device` within that job.
+func (v *Vault) GetToken(namespace, job, device, encryptionKey string) (string, error) {
 	client, err := v.roleClient()
 	if err != nil {
 		return "", err
 	}
+
 	// SecureTokenPath **must** be a path to a KV version 1 store
 	// We should NEVER track the history of tokens under this path
-	response, err := client.Logical().Read(v.config.SecureTokenPath)
-	if response == nil {
-		return "", fmt.Errorf("No keys have been stored for accessing the requested namespace %s", namespace)
-	} else if err != nil {
+	namespaceToken, err := v.readSecureEntry(job)
+	if err != nil {
 		return "", err
+	} else if namespaceToken == "" {
+		return "", fmt.Errorf("No keys have been stored for rotation job %s", job)
 	}
 
 	var (
-		namespaceToken string
-		ok             bool
-		renewable      bool = false
+		renewable bool = false
+		legacy    bool
 	)
-	if namespaceToken, ok = response.Data[namespace].(string); !ok {
-		return "", fmt.Errorf("No keys have been stored for accessing the requested namespace %s", namespace)
+
+	if namespaceToken, legacy, err = v.decryptInternal(namespaceToken, secureTokenData(job), true); err != nil {
+		return "", fmt.Errorf("Unable to decrypt token for rotation job %s: %w", job, err)
 	}
 
-	key, err := v.GetEncryptionKey()
-	if err != nil {
-		return "", err
+	// Tokens stored before the envelope format are bound to nothing
+	// so are moved to it as soon as they are read
+	if legacy {
+		if _, err := v.reencryptEntry(client, job, v.migrateSecureEntry); err != nil {
+			log.Errorf("Unable to re-encrypt legacy token for rotation job %s: %v", job, err)
+		}
 	}
-	namespaceToken = v.Decrypt(namespaceToken, key)
 
 	// TODO
 	// Check if this token has expired before logging in with it.
@@ -261,6 +536,11 @@ func (v *Vault) GetToken(namespace, encryptionKey string) (string, error) {
 		return STANDBY, err
 	}
 
+	var devicePolicy string = devicePolicyName(job, device)
+	if policies, err := s.TokenPolicies(); err != nil || !slices.Contains(policies, devicePolicy) {
+		return "", fmt.Errorf("No paths in job %s are mapped to device %s", job, device)
+	}
+
 	// If the namespace token has not expired, create a child token
 	// from it to send back to the agent
 	client, err = v.tokenClient(namespaceToken, namespace)
@@ -271,21 +551,31 @@ func (v *Vault) GetToken(namespace, encryptionKey string) (string, error) {
 	// now create a child token
 	childTokenLease, err := client.Auth().Token().Create(&vault.TokenCreateRequest{
 		DisplayName:    fmt.Sprintf("Auto-Rotation"),
+		Policies:       []string{devicePolicy},
 		TTL:            TTL,
 		ExplicitMaxTTL: MAX_TTL,
 		Renewable:      &renewable,
 	})
 	if err != nil {
-		return "", fmt.Errorf("Failed to create a limited child token for namespace %s: %s", namespace, err)
+		return "", fmt.Errorf("Failed to create a limited child token for job %s in namespace %s: %s", job, namespace, err)
 	}
 
-	var encrypted string = v.Encrypt(childTokenLease.Auth.ClientToken, encryptionKey)
+	// The agent has no access to Thor's own encryption so tokens
+	// sent to an agent are always encrypted with the agents API key
+	// and bound to the device they were issued to
+	encrypted, err := v.Encrypt(childTokenLease.Auth.ClientToken, encryptionKey, AssociatedData{
+		Purpose: PURPOSE_AGENT_TOKEN,
+		Device:  device,
+	})
+	if err != nil {
+		return "", err
+	}
 
 	data := make(map[string]interface{})
 	data["value"] = encrypted
 
 	client.SetWrappingLookupFunc(func(string, string) string { return TTL })
-	response, err = client.Logical().Write("/sys/wrapping/wrap", data)
+	response, err := client.Logical().Write("/sys/wrapping/wrap", data)
 	if err != nil {
 		return "", err
 	}
@@ -295,16 +585,132 @@ func (v *Vault) GetToken(namespace, encryptionKey string) (string, error) {
 }
 
 // encrypt a string and return the result
-func (v *Vault) Encrypt(what, key string) string {
-	encrypted, _ := encrypt([]byte(what), key)
-	return base64.StdEncoding.EncodeToString(encrypted)
+func (v *Vault) Encrypt(what, key string, ad AssociatedData) (string, error) {
+	encrypted, err := encrypt([]byte(what), key, ad)
+	if err != nil {
+		return "", fmt.Errorf("Unable to encrypt: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
 }
 
 // Decrypt an encrypted string and return the plaintext
-func (v *Vault) Decrypt(what, key string) string {
-	passphrase, _ := base64.StdEncoding.DecodeString(what)
-	decrypted, _ := decrypt(passphrase, key)
-	return string(decrypted)
+//
+// The associated data must match that used for encryption. Ciphertexts
+// created before the envelope format are refused.
+func (v *Vault) Decrypt(what, key string, ad AssociatedData) (string, error) {
+	decrypted, _, err := v.decrypt(what, key, ad, false)
+	return decrypted, err
+}
+
+// Decrypt an encrypted string, accepting ciphertexts created before
+// the envelope format if `allowLegacy` is set
+//
+// Legacy ciphertexts are bound to no associated data so are only
+// accepted where the caller re-encrypts them. Reports whether the
+// ciphertext was in the legacy format.
+func (v *Vault) decrypt(what, key string, ad AssociatedData, allowLegacy bool) (string, bool, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(what)
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to decode ciphertext: %w", err)
+	}
+
+	if isEnvelope(ciphertext) {
+		decrypted, err := decrypt(ciphertext, key, ad)
+		if err != nil {
+			return "", false, fmt.Errorf("Unable to decrypt: %w", err)
+		}
+		return string(decrypted), false, nil
+	}
+
+	if !allowLegacy {
+		return "", false, fmt.Errorf("Unable to decrypt: ciphertext pre-dates the envelope format")
+	}
+
+	log.Warnf("Decrypting legacy ciphertext for %s %s", ad.Purpose, ad.Device)
+	decrypted, err := decryptLegacy(ciphertext, key)
+	if err != nil {
+		return "", true, fmt.Errorf("Unable to decrypt: %w", err)
+	}
+	return string(decrypted), true, nil
+}
+
+// Encrypt material owned by the Thor server
+//
+// If a transit key has been configured, encryption is carried out
+// by Vault, otherwise the current version of the local encryption
+// key is used and the ciphertext prefixed with that version.
+//
+// Associated data only applies to the local key, transit
+// ciphertexts are already authenticated by Vault.
+func (v *Vault) encryptInternal(what string, ad AssociatedData) (string, error) {
+	if v.config.Transit != nil {
+		return v.transitEncrypt(what)
+	}
+
+	// Always encrypt with the latest key in case it has been
+	// rotated by another process since it was last loaded
+	keys, err := v.encryptionKeys(true)
+	if err != nil {
+		return "", err
+	}
+
+	if keys == nil {
+		return "", fmt.Errorf("No encryption key has been created")
+	}
+
+	encrypted, err := v.Encrypt(what, keys.keys[keys.current], ad)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:v%d:%s", KEY_HEADER, keys.current, encrypted), nil
+}
+
+// Decrypt material owned by the Thor server
+//
+// Ciphertexts without a version header pre-date key
+// rotation and are decrypted with the first key version.
+// Those pre-dating the envelope format are only accepted
+// if `allowLegacy` is set, see Vault.decrypt.
+func (v *Vault) decryptInternal(what string, ad AssociatedData, allowLegacy bool) (string, bool, error) {
+	if v.config.Transit != nil {
+		decrypted, err := v.transitDecrypt(what)
+		return decrypted, false, err
+	}
+
+	version, ciphertext := keyVersion(what)
+	keys, err := v.encryptionKeys(false)
+	if err != nil {
+		return "", false, err
+	}
+
+	if keys == nil || keys.keys[version] == "" {
+		if keys, err = v.encryptionKeys(true); err != nil {
+			return "", false, err
+		}
+	}
+
+	if keys == nil || keys.keys[version] == "" {
+		return "", false, fmt.Errorf("Encryption key version %d is not available", version)
+	}
+	return v.decrypt(ciphertext, keys.keys[version], ad, allowLegacy)
+}
+
+// Re-encrypt a rotation token with the current key, accepting
+// tokens stored before the envelope format
+func (v *Vault) migrateSecureEntry(job, ciphertext string) (string, error) {
+	plaintext, _, err := v.decryptInternal(ciphertext, secureTokenData(job), true)
+	if err != nil {
+		return "", err
+	}
+	return v.encryptInternal(plaintext, secureTokenData(job))
+}
+
+// Associated data for rotation tokens held in the secure path
+func secureTokenData(job string) AssociatedData {
+	return AssociatedData{
+		Purpose: PURPOSE_SECURE_TOKEN,
+		Device:  job,
+	}
 }
 
 // / Searches a vault namespace for a given password
@@ -316,37 +722,23 @@ func (v *Vault) Search(password, token, namespace string, results *[]Result) err
 		return err
 	}
 
-	// first get a list of all KV paths
-
-	log.Debug("Getting mount points")
-	mounts, err := client.Logical().Read("/sys/mounts")
+	// first get a list of all KV mounts
+	resolver, err := v.resolver(client)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Found %d mounts", len(mounts.Data))
-	kv := make([]string, 0)
-	for k, data := range mounts.Data {
-		details := data.(map[string]interface{})
-		if details["type"].(string) == "kv" {
-			options := details["options"].(map[string]interface{})
-			if options["version"].(string) == "2" {
-				k = strings.ReplaceAll(fmt.Sprintf("%s/metadata/", k), "//", "/")
-			}
-			kv = append(kv, k)
-		}
-	}
-
+	var mounts []kv.Mount = resolver.Mounts()
 	kvchan := make(chan []string)
-	for _, path := range kv {
-		go func(password, token, namespace, path string) {
-			results, _ := v.getKVSecrets(password, token, namespace, path)
+	for _, mount := range mounts {
+		go func(password, token, namespace string, mount kv.Mount) {
+			results, _ := v.getKVSecrets(password, token, namespace, &kv.Secret{Mount: mount})
 			kvchan <- results
-		}(password, token, namespace, path)
+		}(password, token, namespace, mount)
 	}
 
 	secrets := make([]string, 0)
-	for range kv {
+	for range mounts {
 		k := <-kvchan
 		secrets = append(secrets, k...)
 	}
@@ -359,6 +751,7 @@ func (v *Vault) Search(password, token, namespace string, results *[]Result) err
 	return nil
 }
 
+// Clears the rotation record of a secret
 func (v *Vault) ClearRotation(token, namespace, path string) {
 	client, err := v.tokenClient(token, namespace)
 	if err != nil {
@@ -366,32 +759,13 @@ func (v *Vault) ClearRotation(token, namespace, path string) {
 		return
 	}
 
-	var v2 bool = false
-	// Get data at path
-	secret, err := client.Logical().Read(path)
-	if err != nil || secret == nil {
+	secret, err := v.resolve(client, path)
+	if err != nil {
+		log.Error(err)
 		return
 	}
-	log.Errorf("%+v", err)
-
-	data := make(map[string]interface{})
-	if _, ok := secret.Data["data"].(map[string]interface{}); ok {
-		data = secret.Data["data"].(map[string]interface{})
-		v2 = true
-	} else {
-		data = secret.Data
-	}
 
-	d := make(map[string]interface{})
-	data["rotated"] = ""
-	if v2 {
-		d["data"] = data
-	} else {
-		d = data
-	}
-
-	_, err = client.Logical().Write(path, d)
-	if err != nil {
+	if err = v.writeRecord(client, secret, nil); err != nil {
 		log.Error(err)
 	}
 }
@@ -400,13 +774,15 @@ func (v *Vault) ClearRotation(token, namespace, path string) {
 //
 // `search` can be either a key at a given path, or the secret value at a given path
 //
-// If a match is found, the value stored at that key will be updated
-func (v *Vault) Rotate(path, token, search, namespace string, compromised bool, logChannel *chan loki.SimpleMessage) []error {
+// If a match is found, the value stored at that key will be updated and the key
+// added to the rotation record of the secret under `job`. For KV version 2, a
+// secret changed by another writer during rotation is re-read and the new values
+// re-applied to only the matching keys. A `ConflictError` is returned if the
+// secret could still not be written.
+func (v *Vault) Rotate(path, token, search, namespace string, compromised bool, job RotationJob, logChannel *chan loki.SimpleMessage) []error {
 	var (
 		errors []error = make([]error, 0)
 		err    error
-		ok     bool
-		v2     bool = false
 	)
 	search = strings.ToLower(search)
 	client, err := v.tokenClient(token, namespace)
@@ -415,122 +791,135 @@ func (v *Vault) Rotate(path, token, search, namespace string, compromised bool,
 		return errors
 	}
 
-	// Get data at path
-	secret, err := client.Logical().Read(path)
+	secret, err := v.resolve(client, path)
 	if err != nil {
 		errors = append(errors, err)
 		return errors
 	}
 
-	if secret == nil {
-		return errors
-	}
-
-	data := make(map[string]interface{})
-	if _, ok := secret.Data["data"].(map[string]interface{}); ok {
-		data = secret.Data["data"].(map[string]interface{})
-		v2 = true
-	} else {
-		data = secret.Data
-	}
+	// Passwords are generated once per key and re-used
+	// if the write has to be retried after a conflict
+	var (
+		passwords map[string]string = make(map[string]string)
+		targeted  []string          = make([]string, 0)
+	)
 
-	var rotated []string = make([]string, 0)
-	if val, ok := data["rotated"]; ok {
-		r := strings.Split(val.(string), ",")
-		for _, s := range r {
-			if s != "" {
-				rotated = append(rotated, s)
+	data, err := v.update(client, secret, func(data map[string]interface{}) bool {
+		var changed bool = false
+		for key, value := range data {
+			var (
+				str, _           = value.(string)
+				keysearch   bool = strings.ToLower(key) == search && !compromised
+				valuesearch bool = strings.ToLower(str) == search && compromised
+			)
+
+			if (!keysearch && !valuesearch) || key == LEGACY_ROTATED_KEY {
+				continue
 			}
-		}
-	}
 
-	var changed bool = false
-	for key, value := range data {
-		// Never update the rotated key at a given path
-		if key == "rotated" {
-			continue
-		}
+			newPass, ok := passwords[key]
+			if !ok {
+				// Generate a new secret
+				*logChannel <- loki.SimpleMessage{
+					Time:    time.Now().Format("2006-01-02 15:04:05"),
+					Host:    "thor",
+					Message: fmt.Sprintf("Generating new password for %s/%s", namespace, path),
+				}
 
-		var (
-			keysearch   bool = strings.ToLower(key) == search && !compromised
-			valuesearch bool = strings.ToLower(value.(string)) == search && compromised
-		)
+				if newPass, err = v.generatePassword(client); err != nil {
+					errors = append(errors, err)
+					continue
+				}
+				passwords[key] = newPass
+				targeted = append(targeted, key)
+			}
 
-		if keysearch || valuesearch {
-			var update bool = true
+			data[key] = newPass
+			changed = true
+		}
 
-			// Generate a new secret
+		if changed {
 			*logChannel <- loki.SimpleMessage{
 				Time:    time.Now().Format("2006-01-02 15:04:05"),
 				Host:    "thor",
-				Message: fmt.Sprintf("Generating new password for %s/%s", namespace, path),
-			}
-
-			s, err := client.Logical().Write("gen/password", map[string]interface{}{})
-			if err != nil {
-				errors = append(errors, fmt.Errorf("Unable to generate password: %w", err))
-				update = false
-			}
-
-			var newPass string
-			if newPass, ok = s.Data["value"].(string); !ok {
-				errors = append(errors, fmt.Errorf("Data type assertion failed: %T %#v", s.Data["data"], s.Data["data"]))
-				update = false
+				Message: fmt.Sprintf("Storing updated credentials for %s/%s", namespace, path),
 			}
+		}
+		return changed
+	})
 
-			if update {
-				rotated = append(rotated, key)
-				value = newPass
-				changed = true
-				if v.config.PasswordPolicy != nil {
-					reg := regexp.MustCompile(fmt.Sprintf("[%s]", v.config.PasswordPolicy.ExcludeCharacters))
-					newPass = reg.ReplaceAllString(newPass, "")
-					value = newPass[:v.config.PasswordPolicy.Length]
-				}
+	if err != nil {
+		if conflict, ok := err.(*ConflictError); ok {
+			conflict.Keys = targeted
+			*logChannel <- loki.SimpleMessage{
+				Time:    time.Now().Format("2006-01-02 15:04:05"),
+				Host:    "thor",
+				Message: conflict.Error(),
 			}
+			errors = append(errors, conflict)
+		} else {
+			errors = append(errors, fmt.Errorf("Unable to write secret: %w", err))
 		}
-		data[key] = value
-	}
-
-	// we store a list of keys that have been rotated back into vault
-	// to allow server credential management scripts to understand
-	// any and all accounts to update keys for.
-	data["rotated"] = strings.Join(rotated, ",")
-	d := make(map[string]interface{})
-	if v2 {
-		d["data"] = data
-	} else {
-		d = data
-	}
-
-	if changed {
-		// Generate a new secret
-		*logChannel <- loki.SimpleMessage{
-			Time:    time.Now().Format("2006-01-02 15:04:05"),
-			Host:    "thor",
-			Message: fmt.Sprintf("Storing updated credentials for %s/%s", namespace, path),
-		}
+		return errors
+	}
 
-		_, err = client.Logical().Write(path, d)
-		if err != nil {
-			errors = append(errors, fmt.Errorf("Unable to write secret: %w", err))
+	if data == nil {
+		return errors
+	}
+
+	// we record the keys that have been rotated to allow server
+	// credential management scripts to understand any and all
+	// accounts to update keys for.
+	var rotated []string = make([]string, 0)
+	for _, key := range targeted {
+		if data[key] == passwords[key] {
+			rotated = append(rotated, key)
 		}
 	}
 
+	if err = v.recordRotation(client, secret, job, rotated); err != nil {
+		errors = append(errors, fmt.Errorf("Credentials rotated but rotation state could not be recorded for %s: %w", path, err))
+	}
 	return errors
 }
 
+// Generate a new password conforming to the password policy
+func (v *Vault) generatePassword(client *vault.Client) (string, error) {
+	s, err := client.Logical().Write("gen/password", map[string]interface{}{})
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate password: %w", err)
+	}
+
+	if s == nil {
+		return "", fmt.Errorf("Unable to generate password: no data returned")
+	}
+
+	newPass, ok := s.Data["value"].(string)
+	if !ok {
+		return "", fmt.Errorf("Data type assertion failed: %T %#v", s.Data["value"], s.Data["value"])
+	}
+
+	if v.config.PasswordPolicy != nil {
+		reg := regexp.MustCompile(fmt.Sprintf("[%s]", v.config.PasswordPolicy.ExcludeCharacters))
+		newPass = reg.ReplaceAllString(newPass, "")
+		if len(newPass) > v.config.PasswordPolicy.Length {
+			newPass = newPass[:v.config.PasswordPolicy.Length]
+		}
+	}
+	return newPass, nil
+}
+
 type child struct {
 	Path   string
 	Secret vault.Secret
 }
 
 // finds a list of paths containing password from kv store
-func (v *Vault) getKVSecrets(password, token, namespace, path string) ([]string, error) {
+//
+// `folder` is listed and any folders found beneath it searched in turn.
+func (v *Vault) getKVSecrets(password, token, namespace string, folder *kv.Secret) ([]string, error) {
 	secrets := make([]string, 0)
-	if string(path[0]) != "/" {
-		path = "/" + path
-	}
+	var path string = folder.ListPath()
 	log.Debugf("Checking %s", path)
 
 	client, _ := v.tokenClient(token, namespace)
@@ -546,30 +935,24 @@ func (v *Vault) getKVSecrets(password, token, namespace, path string) ([]string,
 	}
 
 	secretPaths := make([]string, 0)
-	folders := make([]string, 0)
+	folders := make([]*kv.Secret, 0)
 	for _, k := range contents.Data["keys"].([]interface{}) {
-		key := strings.ReplaceAll(fmt.Sprintf("%s%s", path, k.(string)), "//", "/")
-		if key[len(key)-1:] == "/" {
-			folders = append(folders, key)
+		name := k.(string)
+		if strings.HasSuffix(name, "/") {
+			folders = append(folders, folder.Child(name))
 		} else {
-			// If this is a KV version 2 path, we read secrets from data, not metadata
-			ps := strings.Split(key, "/")
-			if ps[2] == "metadata" {
-				ps[2] = "data"
-				key = strings.Join(ps, "/")
-			}
-			secretPaths = append(secretPaths, key)
+			secretPaths = append(secretPaths, folder.Child(name).DataPath())
 		}
 	}
 
 	// Branch out for folders
 	if len(folders) != 0 {
 		childrensChannel := make(chan []string, 1)
-		for _, p := range folders {
-			go func(password, token, namespace, path string) {
-				results, _ := v.getKVSecrets(password, token, namespace, path)
+		for _, f := range folders {
+			go func(password, token, namespace string, folder *kv.Secret) {
+				results, _ := v.getKVSecrets(password, token, namespace, folder)
 				childrensChannel <- results
-			}(password, token, namespace, p)
+			}(password, token, namespace, f)
 		}
 
 		for range folders {
@@ -587,7 +970,7 @@ func (v *Vault) getKVSecrets(password, token, namespace, path string) ([]string,
 				Path: p,
 			}
 			secret, err := client.Logical().Read(p)
-			if err == nil {
+			if err == nil && secret != nil {
 				c.Secret = *secret
 			}
 			childrensChannel <- &c
@@ -597,16 +980,10 @@ func (v *Vault) getKVSecrets(password, token, namespace, path string) ([]string,
 	// Secrets may come back out of order so just iterate the length
 	for range secretPaths {
 		secret := <-childrensChannel
-		data := make(map[string]interface{})
-
-		if _, ok := secret.Secret.Data["data"].(map[string]interface{}); ok {
-			data = secret.Secret.Data["data"].(map[string]interface{})
-		} else {
-			data = secret.Secret.Data
-		}
+		data := secretData(&secret.Secret, folder.V2())
 
 		for _, value := range data {
-			if value.(string) == password {
+			if s, ok := value.(string); ok && s == password {
 				secrets = append(secrets, secret.Path)
 			}
 		}
@@ -621,29 +998,28 @@ func (v *Vault) Read(path, token, namespace string) (map[string]string, error) {
 	if err != nil {
 		return credentials, err
 	}
-	secret, err := client.Logical().Read(path)
+	resolved, err := v.resolve(client, path)
 	if err != nil {
 		return credentials, err
 	}
 
-	data := make(map[string]interface{})
-	if _, ok := secret.Data["data"].(map[string]interface{}); ok {
-		data = secret.Data["data"].(map[string]interface{})
-	} else {
-		data = secret.Data
+	secret, err := client.Logical().Read(resolved.DataPath())
+	if err != nil {
+		return credentials, err
 	}
 
-	var (
-		rotated      string
-		ok           bool
-		rotationList []string
-	)
-	if rotated, ok = data["rotated"].(string); ok {
-		rotationList = strings.Split(rotated, ",")
+	if secret == nil {
+		return credentials, fmt.Errorf("No secret found at %s", path)
 	}
-	for _, key := range rotationList {
-		var value string
-		if value, ok = data[key].(string); ok {
+
+	data := secretData(secret, resolved.V2())
+	record, err := v.readRecord(client, resolved)
+	if err != nil {
+		return credentials, err
+	}
+
+	for _, key := range record.Keys {
+		if value, ok := data[key].(string); ok {
 			credentials[key] = value
 		}
 	}
@@ -3,4 +3,59 @@ function toggle(source, name) {
     for(var i=0, n=checkboxes.length;i<n;i++) {
         checkboxes[i].checked = source.checked;
     }
-}
\ No newline at end of file
+}
+
+// Load a single level of the vault tree into `parent`
+//
+// Mounts and folders are expanded on click, secrets may be selected in full
+// or expanded to select individual keys for rotation.
+function browseVault(token, namespace, path, parent) {
+    $.ajax({
+        type: 'POST',
+        url: '/api/v1/browse',
+        contentType: 'application/json',
+        data: JSON.stringify({token: token, namespace: namespace, path: path}),
+        success: function (data) {
+            parent.empty();
+            $.each(data.message, function(i, node) {
+                var item = $('<div class="item"></div>');
+                var children = $('<div class="list"></div>');
+                switch (node.type) {
+                case "mount":
+                case "folder":
+                    item.append($('<i class="folder icon"></i>'));
+                    item.append($('<a class="header"></a>').text(node.name).on('click', function() {
+                        if (children.is(':empty')) {
+                            browseVault(token, namespace, node.path, children);
+                        } else {
+                            children.empty();
+                        }
+                    }));
+                    break;
+                case "secret":
+                    item.append($('<input type="checkbox" />').attr('name', namespace + '[]').val(node.path));
+                    item.append($('<i class="lock icon"></i>'));
+                    item.append($('<a class="header"></a>').text(node.name).on('click', function() {
+                        if (children.is(':empty')) {
+                            browseVault(token, namespace, node.path, children);
+                        } else {
+                            children.empty();
+                        }
+                    }));
+                    break;
+                case "key":
+                    item.append($('<input type="checkbox" />').attr('name', 'keys[]').val(node.path + '|' + node.name));
+                    item.append($('<i class="key icon"></i>'));
+                    item.append($('<span></span>').text(node.name));
+                    break;
+                }
+                item.append(children);
+                parent.append(item);
+            });
+        },
+        error: function (data) {
+            var message = data.responseJSON ? data.responseJSON.message : 'An error occurred.';
+            parent.empty().append($('<div class="ui negative message"></div>').text(message));
+        },
+    });
+}